@@ -4,46 +4,89 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"net"
+	"hash"
+	"io"
+	"io/ioutil"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/Ak-Army/logcollector/internal/ssh_client"
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/deadletter"
+	"github.com/Ak-Army/logcollector/internal/decompress"
+	"github.com/Ak-Army/logcollector/internal/parser"
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/state"
 	"github.com/Ak-Army/logcollector/internal/storage"
-	"github.com/Ak-Army/logcollector/internal/storage/influxdb"
-	"github.com/Ak-Army/logcollector/internal/storage/loki"
 
 	"github.com/Ak-Army/cli"
 	"github.com/Ak-Army/xlog"
-	"github.com/go-logfmt/logfmt"
 	"github.com/sgreben/flagvar"
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
-var apps = []string{}
+const (
+	maxLineSize     = 10 * 1024 * 1024
+	checkpointLines = 10000
+)
 
 func init() {
 	cli.RootCommand().AddCommand("collect", &Collect{})
 }
 
 type Collect struct {
+	Config          string          `flag:"config, config file (yaml or toml)"`
 	Apps            flagvar.Strings `flag:"apps, app name"`
-	Servers         flagvar.Strings `flag:"servers, app name"`
+	Servers         flagvar.Strings `flag:"servers, server name, overrides the servers of every source"`
 	FromServer      string          `flag:"fs, from server"`
 	FromApp         string          `flag:"fa, from app"`
 	Date            string          `flag:"date, date"`
+	From            string          `flag:"from, first day of the range: 20060102, 2006-01-02, today, yesterday or -7d"`
+	To              string          `flag:"to, last day of the range, yesterday by default"`
 	DropDb          bool            `flag:"dropDB, drop db"`
 	DropMeasurement bool            `flag:"dropMeas, drop measurement"`
 	Loki            bool            `flag:"loki, send data to loki"`
+	User            string          `flag:"user, ssh user"`
+	Host            string          `flag:"host, syslog server of the sources without host, can be a Host of the ssh config"`
+	Port            int             `flag:"port, ssh port"`
+	Identity        string          `flag:"identity, ssh private key file"`
+	Jump            string          `flag:"jump, jump hosts like ssh -J: [user@]host[:port],..."`
+	Local           bool            `flag:"local, read the sources without type from the local disk instead of ssh"`
+	Stream          bool            `flag:"stream, parse remote files while downloading, without local copy"`
+	DownloadWorkers int             `flag:"download-workers, number of files downloaded in parallel"`
+	ParseWorkers    int             `flag:"parse-workers, number of files parsed in parallel"`
+	State           string          `flag:"state, state file of the shipped files"`
+	Reset           bool            `flag:"reset, ship the files again even if the state file has them"`
+	DeadLetter      string          `flag:"dead-letter, file of the lines which could not be parsed or were rejected"`
+	WAL             string          `flag:"wal, directory of the write-ahead log of the storage"`
 	ctx             context.Context
-	syslog          ssh_client.SSHClient
-	fileProcess     chan string
+	conf            *config.Config
+	sources         []*logSource
+	store           storage.Storage
+	state           *state.Store
+	wg              *sync.WaitGroup
+	parsers         map[string]parser.Parser
+	retry           retry.Policy
+	report          *report
+	unsaved         *unsaved
+	deadLetter      *deadletter.Writer
+	download        chan logFile
+	parse           chan logFile
+}
+
+type logFile struct {
+	src     *logSource
+	app     string
+	path    string
+	local   string
+	size    int64
+	modTime time.Time
+	// offset is the number of decompressed bytes already shipped.
+	offset int64
 }
 
 func (c Collect) Help() string {
@@ -55,268 +98,576 @@ func (c Collect) Synopsis() string {
 }
 
 func (c Collect) Run(ctx context.Context) error {
+	return fail(c.run(ctx))
+}
+
+func (c Collect) run(ctx context.Context) error {
+	var err error
+	if c.conf, err = config.Load(c.Config); err != nil {
+		return err
+	}
+	if c.Loki {
+		c.conf.Storage = "loki"
+	}
+	if c.Local {
+		c.conf.Source.Type = "local"
+	}
+	if c.Stream {
+		c.conf.Pipeline.Stream = true
+	}
+	if c.DownloadWorkers > 0 {
+		c.conf.Pipeline.DownloadWorkers = c.DownloadWorkers
+	}
+	if c.ParseWorkers > 0 {
+		c.conf.Pipeline.ParseWorkers = c.ParseWorkers
+	}
+	if c.conf.Pipeline.DownloadWorkers < 1 || c.conf.Pipeline.ParseWorkers < 1 {
+		return errors.New("download and parse workers must be at least 1")
+	}
+	if c.State != "" {
+		c.conf.State = c.State
+	}
+	if c.DeadLetter != "" {
+		c.conf.DeadLetter = c.DeadLetter
+	}
+	if c.WAL != "" {
+		c.conf.WAL.Dir = c.WAL
+	}
+	if c.conf.State != "" {
+		if c.state, err = state.Open(c.conf.State); err != nil {
+			return fmt.Errorf("unable to open state file: %w", err)
+		}
+	}
 	fromApp := false
 	if c.FromApp == "" {
 		fromApp = true
 	}
 	if len(c.Apps.Values) == 0 {
-		for _, app := range apps {
+		for _, app := range c.conf.Source.Apps {
 			if fromApp || c.FromApp == app {
 				c.Apps.Set(app)
 				fromApp = true
 			}
 		}
 	}
-	if len(c.Servers.Values) == 0 {
-		c.Servers.Set("*")
+	if c.parsers, err = newParsers(c.conf, c.Apps.Values); err != nil {
+		return err
 	}
-	if c.Date == "" {
-		c.Date = time.Now().Add(time.Hour * -24).Format("20060102")
+	days, err := c.days(time.Now())
+	if err != nil {
+		return err
 	}
 	c.ctx = ctx
-	sshConfig := &ssh.ClientConfig{
-		User: "peter.hunyadvari",
-		Auth: []ssh.AuthMethod{
-			c.sshAgent(),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	c.syslog = ssh_client.SSHClient{
-		Config: sshConfig,
-		Host:   "syslog-server",
-		Port:   22,
-	}
-	maxDownloader := 1
-	maxFileProcesor := 1
-	download := make(chan string)
-	c.fileProcess = make(chan string, 3)
-	wg := sync.WaitGroup{}
-	for i := 0; i < maxDownloader; i++ {
-		go func() {
-			for {
-				path := <-download
-				wg.Add(1)
-				if !c.downloadFile(ctx, path) {
-					download <- path
-				}
-				wg.Done()
-			}
-		}()
+	if err := sshFlags(&c.conf.SSH, c.User, c.Host, c.Port, c.Identity, c.Jump); err != nil {
+		return err
 	}
-	for i := 0; i < maxFileProcesor; i++ {
-		go func() {
-			for {
-				path := <-c.fileProcess
-				wg.Add(1)
-				if !c.processFile(ctx, path) {
-					c.fileProcess <- path
-				}
-				wg.Done()
-			}
-		}()
+	if c.sources, err = newSources(ctx, c.conf, c.Servers.Values); err != nil {
+		return err
+	}
+	defer closeSources(c.sources)
+	if c.store, err = newStorage(ctx, c.conf); err != nil {
+		return err
+	}
+	if c.deadLetter, err = openDeadLetter(c.conf.DeadLetter, c.store); err != nil {
+		c.store.Stop(ctx)
+		return err
+	}
+	if c.deadLetter != nil {
+		defer c.deadLetter.Close()
+	}
+	if err := c.drop(ctx); err != nil {
+		c.store.Stop(ctx)
+		return err
 	}
+	c.retry = newRetry(c.conf.Retry)
+	c.report = &report{}
+	c.unsaved = &unsaved{files: make(map[string]state.File)}
+	c.wg = &sync.WaitGroup{}
+	c.download = make(chan logFile, c.conf.Pipeline.QueueSize)
+	c.parse = make(chan logFile, c.conf.Pipeline.QueueSize)
+	stop := c.startWorkers(ctx)
+	c.collect(ctx, days)
+	stop()
+	stopErr := stopStorage(ctx, c.store)
+	if stopErr == nil {
+		c.saveUnsaved(xlog.FromContext(ctx))
+	}
+	c.report.log(xlog.FromContext(ctx))
+	if c.deadLetter != nil && c.deadLetter.Written() > 0 {
+		xlog.FromContext(ctx).Errorf("Lines written to the dead-letter file %s: %d", c.conf.DeadLetter, c.deadLetter.Written())
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if stopErr != nil {
+		return stopErr
+	}
+	return c.report.err()
+}
 
-	storage := c.storage()
-	defer storage.Stop()
+func (c Collect) drop(ctx context.Context) error {
 	if c.DropDb {
-		if err := storage.DropDatabase(); err != nil {
+		if err := c.store.DropDatabase(ctx); errors.Is(err, storage.ErrNotSupported) {
+			xlog.FromContext(ctx).Warnf("Unable to drop the database: %s", err)
+		} else if err != nil {
 			return err
 		}
 	}
-	fromServer := false
-	if c.FromServer == "" {
-		fromServer = true
+	if c.DropMeasurement {
+		for _, app := range c.Apps.Values {
+			if err := c.store.DropApp(ctx, app); errors.Is(err, storage.ErrNotSupported) {
+				xlog.FromContext(ctx).Warnf("Unable to drop %s: %s", app, err)
+			} else if err != nil {
+				return err
+			}
+		}
 	}
-	for _, app := range c.Apps.Values {
-		var dirs []string
-		for _, s := range c.Servers.Values {
-			dirs = append(dirs, fmt.Sprintf(" /var/log/remote/%s/%s/%s/*", s, c.Date, app))
+	return nil
+}
+
+// collect queues the files of the days, it returns when they are shipped or the context is cancelled.
+func (c Collect) collect(ctx context.Context, days []time.Time) {
+	fromServer := c.FromServer == ""
+	log := xlog.FromContext(ctx)
+	for i, day := range days {
+		if ctx.Err() != nil {
+			break
 		}
-		cmd := fmt.Sprintf("ls %s", strings.Join(dirs, " "))
-		var cmdOut bytes.Buffer
-		err := c.syslog.RunCommand(&ssh_client.SSHCommand{
-			Path:   cmd,
-			Env:    []string{},
-			Stdin:  os.Stdin,
-			Stdout: &cmdOut,
-			Stderr: os.Stderr,
-		})
-		log := xlog.Copy(xlog.FromContext(ctx))
-		if err == nil {
-			if c.DropMeasurement {
-				if err := storage.DropApp(app); err != nil {
-					return err
+		date := day.Format("20060102")
+		log.Infof("Collect %s (%d/%d)", date, i+1, len(days))
+		for _, app := range c.Apps.Values {
+			log := xlog.Copy(log)
+			files, err := c.list(day, app)
+			if err != nil {
+				log.Errorf("Unable to list files of %s: %s", app, err)
+				c.report.fail(fmt.Sprintf("files of %s on %s", app, date), err)
+				continue
+			}
+			if !c.shipped(files) {
+				err := c.store.DeleteByDate(ctx, app, day, day.AddDate(0, 0, 1))
+				if errors.Is(err, storage.ErrNotSupported) {
+					log.Warnf("Unable to delete %s of %s, the shipped lines may be duplicated: %s", date, app, err)
+				} else if err != nil {
+					// the lines of the day would be duplicated
+					log.Errorf("Unable to delete %s of %s: %s", date, app, err)
+					c.report.fail(fmt.Sprintf("delete of %s on %s", app, date), err)
+					continue
 				}
+				time.Sleep(10 * time.Millisecond)
 			}
-			loc, _ := time.LoadLocation("Local")
-			year, _ := strconv.Atoi(c.Date[0:3])
-			month, _ := strconv.Atoi(c.Date[4:5])
-			day, _ := strconv.Atoi(c.Date[6:7])
-			dateFrom := time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc)
-			storage.DeleteByDate(app, dateFrom, dateFrom.Add(24*time.Hour))
-			time.Sleep(10 * time.Millisecond)
-			scanner := bufio.NewScanner(&cmdOut)
-			for scanner.Scan() {
-				path := scanner.Text()
-				if fromServer || strings.HasPrefix(path, "/var/log/remote/"+c.FromServer) {
+			for _, file := range files {
+				if fromServer || strings.HasPrefix(file.path, file.src.serverPrefix(c.FromServer)) {
 					fromServer = true
-					download <- scanner.Text()
+					if file, ok := c.pending(log, file); ok {
+						c.enqueue(ctx, file)
+					}
 					continue
 				}
-				log.Infof("Skip: %s", path)
-			}
-			if err := scanner.Err(); err != nil {
-				log.Error(err)
+				log.Infof("Skip: %s", file.path)
 			}
 		}
+		c.wg.Wait()
+		if ctx.Err() != nil {
+			log.Infof("Stopped while collecting %s (%d/%d)", date, i+1, len(days))
+			break
+		}
+		log.Infof("Collected %s (%d/%d)", date, i+1, len(days))
 	}
-	wg.Wait()
-	return nil
 }
 
-var s storage.Storage
+// startWorkers starts the download and parse workers, the returned function stops them after the queued files.
+// The files are skipped after the context is cancelled.
+func (c Collect) startWorkers(ctx context.Context) func() {
+	downloaders := &sync.WaitGroup{}
+	for i := 0; i < c.conf.Pipeline.DownloadWorkers; i++ {
+		downloaders.Add(1)
+		go func() {
+			defer downloaders.Done()
+			for file := range c.download {
+				if ctx.Err() != nil || !c.downloadFile(ctx, file) || c.streams(file) {
+					c.wg.Done()
+				}
+			}
+		}()
+	}
+	parsers := &sync.WaitGroup{}
+	for i := 0; i < c.conf.Pipeline.ParseWorkers; i++ {
+		parsers.Add(1)
+		go func() {
+			defer parsers.Done()
+			for file := range c.parse {
+				if ctx.Err() == nil {
+					c.processFile(ctx, file)
+				}
+				os.Remove(file.local)
+				c.wg.Done()
+			}
+		}()
+	}
+	return func() {
+		close(c.download)
+		downloaders.Wait()
+		close(c.parse)
+		parsers.Wait()
+	}
+}
 
-func (c Collect) storage() storage.Storage {
-	if c.Loki {
-		if s == nil {
-			s = loki.New(xlog.FromContext(c.ctx), 1000, 2000000, 5*time.Second)
+// enqueue adds the file to the download queue, it blocks while the queue is full.
+// The file is dropped when the context is cancelled meanwhile.
+func (c Collect) enqueue(ctx context.Context, file logFile) {
+	c.wg.Add(1)
+	select {
+	case c.download <- file:
+	case <-ctx.Done():
+		c.wg.Done()
+	}
+}
+
+// list returns the files of the app on the given day of every source.
+func (c Collect) list(day time.Time, app string) ([]logFile, error) {
+	var files []logFile
+	for _, src := range c.sources {
+		if !src.collects(app) {
+			continue
+		}
+		paths, err := src.glob(day, app)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src.name, err)
+		}
+		for _, path := range paths {
+			files = append(files, logFile{src: src, app: app, path: path})
 		}
-		return s
 	}
-	return influxdb.New(xlog.FromContext(c.ctx), 1000, 10000000, 5*time.Second)
+	return files, nil
 }
 
-func (c Collect) sshAgent() ssh.AuthMethod {
-	sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+// days returns the days to collect, yesterday by default.
+func (c Collect) days(now time.Time) ([]time.Time, error) {
+	if c.Date != "" {
+		if c.From != "" || c.To != "" {
+			return nil, errors.New("date can not be used with from and to")
+		}
+		c.From = c.Date
+		c.To = c.Date
+	}
+	if c.From == "" && c.To == "" {
+		c.From = "yesterday"
+	}
+	if c.From == "" {
+		c.From = c.To
+	}
+	if c.To == "" {
+		c.To = "yesterday"
+	}
+	from, err := parseDay(c.From, now)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseDay(c.To, now)
 	if err != nil {
-		xlog.FromContext(c.ctx).Fatal(err)
+		return nil, err
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("from %s is after to %s", c.From, c.To)
+	}
+	var days []time.Time
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
 	}
-	return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+	return days, nil
 }
 
-func (c Collect) downloadFile(ctx context.Context, path string) bool {
+// downloadFile streams the file or downloads it for the parse workers, false means it is not queued for parsing.
+// It is retried by the retry policy, a streamed file is resumed from the last shipped line.
+func (c Collect) downloadFile(ctx context.Context, remote logFile) bool {
 	log := xlog.Copy(xlog.FromContext(ctx))
-	log.SetField("path", path)
-	paths := strings.Split(path, "/")
-	if len(paths) < 4 {
-		log.Errorf("Unable to download file, %s", path)
+	log.SetField("source", remote.src.name)
+	log.SetField("path", remote.path)
+	stream := c.streams(remote)
+	if !stream {
+		remote.local = remote.src.localCopy(remote.path)
+	}
+	err := c.retry.Do(ctx, func() error {
+		if stream {
+			return c.streamFile(ctx, log, &remote)
+		}
+		return remote.src.client.Download(remote.local, remote.path)
+	}, func(attempt int, err error) {
+		log.Warnf("Unable to download file, retry %d: %s", attempt, err)
+	})
+	if err != nil {
+		log.Error("Unable to download file: ", err)
+		if ctx.Err() == nil {
+			c.report.fail(remote.src.key(remote.path), err)
+		}
 		return false
 	}
-	file := fmt.Sprintf("%s_%s_%s.log", paths[4], paths[5], paths[7])
-	if err := c.syslog.FileFromRemoteHost(file, path); err != nil {
-		log.Error("Unable to download file")
+	if stream {
+		return true
+	}
+	select {
+	case c.parse <- remote:
+	case <-ctx.Done():
+		os.Remove(remote.local)
 		return false
 	}
-	c.fileProcess <- file
-
 	return true
 }
 
-func (c Collect) processFile(ctx context.Context, file string) bool {
-	log := xlog.Copy(xlog.FromContext(ctx))
-	log.SetField("path", file)
+// streams reports whether the file is parsed while it is read, local files are never copied.
+func (c Collect) streams(file logFile) bool {
+	return c.conf.Pipeline.Stream || file.src.local
+}
 
-	f, err := os.Open(file)
+// streamFile parses the remote file while it is read, without writing it to the local disk.
+// The offset of the file is moved to the last shipped line when it fails.
+func (c Collect) streamFile(ctx context.Context, log xlog.Logger, remote *logFile) error {
+	var start int64
+	if remote.offset > 0 && !decompress.Compressed(remote.path) {
+		start = remote.offset
+	}
+	src, err := remote.src.client.Open(remote.path, start)
 	if err != nil {
-		log.Error("Unable to open file")
-		return false
+		return fmt.Errorf("unable to open remote file: %w", err)
 	}
-	defer f.Close()
-	db := c.storage()
-	lineProcessor := 1
-	line := make(chan string)
-	wg := sync.WaitGroup{}
-	for i := 0; i < lineProcessor; i++ {
-		go func() {
-			for {
-				l := <-line
-				if err := c.processLine(db, l, file); err != nil {
-					log.Error(err)
-					line <- l
-					continue
-				}
-				wg.Done()
-			}
-		}()
+	defer src.Close()
+	var raw io.Reader = src
+	var h hash.Hash
+	if start == 0 {
+		h = sha256.New()
+		raw = io.TeeReader(src, h)
 	}
-	scanner := bufio.NewScanner(f)
-	sent := 0
-	for scanner.Scan() {
-		wg.Add(1)
-		sent++
-		line <- scanner.Text()
+	r, err := decompress.NewReader(raw)
+	if err != nil {
+		return fmt.Errorf("unable to decompress file: %w", err)
+	}
+	defer r.Close()
+	sent, offset, err := c.processStream(ctx, log, *remote, start, r)
+	log.Infof("Sent: %d", sent)
+	if err != nil {
+		if offset > remote.offset {
+			remote.offset = offset
+		}
+		return fmt.Errorf("unable to stream file: %w", err)
 	}
-	wg.Wait()
-	if err := scanner.Err(); err != nil {
+	c.done(ctx, log, *remote, offset, raw, h)
+	return nil
+}
+
+func (c Collect) processFile(ctx context.Context, file logFile) {
+	log := xlog.Copy(xlog.FromContext(ctx))
+	log.SetField("path", file.local)
+
+	err := c.parseFile(ctx, log, file)
+	if err != nil {
 		log.Error(err)
+		if ctx.Err() == nil {
+			c.report.fail(file.src.key(file.path), err)
+		}
+	}
+}
+
+func (c Collect) parseFile(ctx context.Context, log xlog.Logger, file logFile) error {
+	f, err := os.Open(file.local)
+	if err != nil {
+		return fmt.Errorf("unable to open file: %w", err)
 	}
-	//db.Stop()
+	defer f.Close()
+	h := sha256.New()
+	raw := io.TeeReader(f, h)
+	r, err := decompress.NewReader(raw)
+	if err != nil {
+		return fmt.Errorf("unable to decompress file: %w", err)
+	}
+	defer r.Close()
+	sent, offset, err := c.processStream(ctx, log, file, 0, r)
 	log.Infof("Sent: %d", sent)
-	os.Remove(file)
-	return true
+	if err != nil {
+		return err
+	}
+	c.done(ctx, log, file, offset, raw, h)
+	return nil
 }
 
-func (c Collect) processLine(store storage.Storage, raw string, file string) error {
-	logs := strings.SplitN(raw, " ", 4)
-	if len(logs) < 4 {
-		return errors.New("too short log line: " + raw)
-	}
-
-	ll := storage.LogLine{
-		App:    strings.Split(logs[2], "[")[0],
-		Tags:   make(map[string]string),
-		Fields: make(map[string]interface{}),
-		Time:   time.Now(),
-		Size:   len(raw),
-	}
-	v := strings.Split(logs[0], "+")
-	ll.Time, _ = time.Parse("2006-01-02T15:04:05.99999", v[0])
-	ll.Tags["host"] = logs[1]
-	ll.Fields["raw"] = logs[3]
-
-	dec := logfmt.NewDecoder(strings.NewReader(logs[3]))
-	for dec.ScanRecord() {
-		for dec.ScanKeyval() {
-			val := string(dec.Value())
-			key := string(dec.Key())
-			switch key {
-			case "requestBody":
-				continue
-			case "customer":
-				ll.Fields[key] = val
-			case "method", "topic":
-				ll.Tags["method_topic"] = val
-			case "time":
-				v := strings.Split(val, " m=")
-				ll.Time, _ = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", v[0])
-			case "phone", "op", "secondaryProj", "queueId", "userName", "mode":
-				ll.Fields[key] = val
-			case "stat":
-				if apps[0] == "go-queue" {
-					//stat="QueueStat{running=0, completed=0, pending=0, total=0, lastJobTime=1970-01-01 01:00:00 +0100 CET, avWorker=1, busyWorker=0}"
-					kvs := strings.Split(val[10:len(val)-2], ", ")
-					for _, kv := range kvs {
-						queueStat := strings.Split(kv, "=")
-						if i, err := strconv.ParseInt(queueStat[1], 10, 64); err == nil {
-							ll.Fields[queueStat[0]] = i
-						}
-					}
-				}
-				ll.Fields[key] = val
-			default:
-				if i, err := strconv.ParseInt(val, 10, 64); err == nil {
-					ll.Fields[key] = i
-				} else if i, err := strconv.ParseFloat(val, 64); err == nil {
-					ll.Fields[key] = i
-				} else if i, err := time.ParseDuration(val); err == nil {
-					ll.Fields[key] = i.Milliseconds()
-				} else {
-					ll.Fields[key] = val
+// processStream sends every line of r to the storage, r starts at the start offset of the file.
+// Lines before file.offset were already shipped and are skipped.
+// It blocks while the storage is not able to accept more lines.
+// The shipped offset is saved when the context is cancelled, so the next run resumes from it.
+func (c Collect) processStream(ctx context.Context, log xlog.Logger, file logFile, start int64, r io.Reader) (int, int64, error) {
+	var n int64
+	scanner := newLineScanner(r, &n, true)
+	sent := 0
+	lines := 0
+	lineNumber := 0
+	pos := start
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			if pos > file.offset {
+				c.checkpoint(ctx, log, file, state.File{Offset: pos})
+			}
+			return sent, pos, err
+		}
+		pos += n
+		lineNumber++
+		if pos <= file.offset {
+			continue
+		}
+		lines++
+		origin := storage.Origin{
+			Source: file.src.name,
+			File:   file.path,
+			Line:   lineNumber,
+			Raw:    scanner.Text(),
+		}
+		if err := processLine(ctx, c.store, c.parsers[file.app], origin, file.app); err != nil {
+			if ctx.Err() != nil {
+				// the line is sent again by the next run
+				pos -= n
+				if pos > file.offset {
+					c.checkpoint(ctx, log, file, state.File{Offset: pos})
 				}
+				return sent, pos, ctx.Err()
 			}
+			log.Errorf("Line %d: %s", lineNumber, err)
+			c.report.failLine(file.src.key(file.path), lineNumber, origin.Raw, err)
+			deadLetter(c.deadLetter, log, file.app, origin, err)
+		} else {
+			sent++
+		}
+		if lines%checkpointLines == 0 {
+			c.checkpoint(ctx, log, file, state.File{Offset: pos})
+		}
+	}
+	return sent, pos, scanner.Err()
+}
+
+// newLineScanner returns the scanner of the lines of r, n is set to the size of the last line with its line ending.
+// The last line without a line ending is returned only when partial is set, otherwise it is left for a later read.
+func newLineScanner(r io.Reader, n *int64, partial bool) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && !partial && bytes.IndexByte(data, '\n') < 0 {
+			return 0, nil, nil
+		}
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			*n = int64(advance)
+		}
+		return advance, token, err
+	})
+	return scanner
+}
+
+// pending returns the remote file to ship, false when it was already shipped.
+// A partly shipped or grown file is resumed from the shipped offset.
+func (c Collect) pending(log xlog.Logger, file logFile) (logFile, bool) {
+	info, err := file.src.client.Stat(file.path)
+	if err != nil {
+		log.Errorf("Unable to stat %s: %s", file.path, err)
+		return file, true
+	}
+	file.size = info.Size()
+	file.modTime = info.ModTime()
+	if c.state == nil || c.Reset {
+		return file, true
+	}
+	st, ok := c.state.Get(file.src.key(file.path))
+	if !ok {
+		return file, true
+	}
+	if st.Done && st.Unchanged(file.size, file.modTime) {
+		log.Infof("Already shipped: %s", file.path)
+		return file, false
+	}
+	if file.size >= st.Size {
+		file.offset = st.Offset
+	}
+	return file, true
+}
+
+// shipped reports whether any of the files was shipped before.
+func (c Collect) shipped(files []logFile) bool {
+	if c.state == nil || c.Reset {
+		return false
+	}
+	for _, file := range files {
+		if _, ok := c.state.Get(file.src.key(file.path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// unsaved are the states of the files by key, their lines were sent but the storage did not write them yet.
+type unsaved struct {
+	lock  sync.Mutex
+	files map[string]state.File
+}
+
+// checkpoint saves the state of the file when the storage delivered the lines sent before it,
+// otherwise the lines after the previous checkpoint are shipped again by the next run.
+// The states are kept while the storage returns storage.ErrPending and saved with the next checkpoint or after Stop.
+// The storage is flushed until stopTimeout when the context is already done.
+func (c Collect) checkpoint(ctx context.Context, log xlog.Logger, file logFile, st state.File) {
+	if c.state == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), stopTimeout)
+		defer cancel()
+	}
+	st.Size = file.size
+	st.ModTime = file.modTime
+	// the states added during the Flush would be saved before their lines are written
+	c.unsaved.lock.Lock()
+	defer c.unsaved.lock.Unlock()
+	c.unsaved.files[file.src.key(file.path)] = st
+	err := c.store.Flush(ctx)
+	switch {
+	case errors.Is(err, storage.ErrPending):
+		log.Debug("The storage did not write the lines yet, the state is saved later")
+	case err != nil:
+		log.Warn("Unable to flush storage, the state is not saved: ", err)
+		c.unsaved.files = make(map[string]state.File)
+	default:
+		c.save(log)
+	}
+}
+
+// saveUnsaved saves the kept states after the storage was stopped without undelivered lines.
+func (c Collect) saveUnsaved(log xlog.Logger) {
+	if c.state == nil {
+		return
+	}
+	c.unsaved.lock.Lock()
+	defer c.unsaved.lock.Unlock()
+	c.save(log)
+}
+
+// save saves the kept states, the lock of them is held.
+func (c Collect) save(log xlog.Logger) {
+	for key, st := range c.unsaved.files {
+		if err := c.state.Set(key, st); err != nil {
+			log.Error("Unable to save state: ", err)
+		}
+	}
+	c.unsaved.files = make(map[string]state.File)
+}
+
+// done marks the file as shipped, the rest of raw is read to have the checksum of the whole file.
+func (c Collect) done(ctx context.Context, log xlog.Logger, file logFile, offset int64, raw io.Reader, h hash.Hash) {
+	st := state.File{
+		Offset: offset,
+		Done:   true,
+	}
+	if h != nil {
+		if _, err := io.Copy(ioutil.Discard, raw); err == nil {
+			st.Checksum = hex.EncodeToString(h.Sum(nil))
 		}
 	}
-	return store.Send(ll)
+	c.checkpoint(ctx, log, file, st)
 }
 
 // nginx logokhoz
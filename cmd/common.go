@@ -0,0 +1,451 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/deadletter"
+	"github.com/Ak-Army/logcollector/internal/parser"
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/ssh_client"
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/internal/storage/clickhouse"
+	"github.com/Ak-Army/logcollector/internal/storage/elasticsearch"
+	"github.com/Ak-Army/logcollector/internal/storage/fanout"
+	"github.com/Ak-Army/logcollector/internal/storage/file"
+	"github.com/Ak-Army/logcollector/internal/storage/influxdb"
+	"github.com/Ak-Army/logcollector/internal/storage/loki"
+	"github.com/Ak-Army/logcollector/internal/storage/otlp"
+	"github.com/Ak-Army/logcollector/internal/storage/wal"
+
+	"github.com/Ak-Army/xlog"
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// failed is set when a command returned an error, cli only prints it.
+var failed int32
+
+// fail records the error of a command, so the process exits with a non-zero code.
+func fail(err error) error {
+	if err != nil {
+		atomic.StoreInt32(&failed, 1)
+	}
+	return err
+}
+
+// Failed reports whether a command returned an error.
+func Failed() bool {
+	return atomic.LoadInt32(&failed) == 1
+}
+
+func newSSHClient(conf config.SSH) (*ssh_client.SSHClient, error) {
+	host, err := ssh_client.LookupHost(conf.Config, conf.Host)
+	if err != nil {
+		return nil, err
+	}
+	if host.HostName == "" {
+		host.HostName = conf.Host
+	}
+	if conf.User != "" {
+		host.User = conf.User
+	}
+	if host.User == "" {
+		// the local user, like ssh does
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("no ssh user of %s: %w", conf.Host, err)
+		}
+		host.User = u.Username
+	}
+	if conf.Port != 0 {
+		host.Port = conf.Port
+	}
+	if host.Port == 0 {
+		host.Port = 22
+	}
+	keyFiles := conf.KeyFiles
+	if len(keyFiles) == 0 && host.IdentityFile != "" {
+		keyFiles = []string{host.IdentityFile}
+	}
+	auth := ssh_client.Auth{
+		User:                  host.User,
+		Agent:                 conf.Agent,
+		KeyFiles:              keyFiles,
+		Passphrase:            conf.Passphrase,
+		Password:              conf.Password,
+		KnownHosts:            conf.KnownHosts,
+		TrustOnFirstUse:       conf.TrustOnFirstUse,
+		InsecureIgnoreHostKey: conf.InsecureIgnoreHostKey,
+	}
+	sshConfig, err := auth.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client := &ssh_client.SSHClient{
+		Config: sshConfig,
+		Host:   host.HostName,
+		Port:   host.Port,
+	}
+	jumps := conf.Jump
+	if len(jumps) == 0 && host.ProxyJump != "" && host.ProxyJump != "none" {
+		if jumps, err = parseJump(host.ProxyJump); err != nil {
+			return nil, err
+		}
+	}
+	for _, jump := range jumps {
+		hop, err := newSSHClient(inheritAuth(jump, conf))
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up jump host %s: %w", jump.Host, err)
+		}
+		client.Jumps = append(client.Jumps, hop.Jumps...)
+		client.Jumps = append(client.Jumps, ssh_client.Hop{
+			Config: hop.Config,
+			Host:   hop.Host,
+			Port:   hop.Port,
+		})
+	}
+	return client, nil
+}
+
+// inheritAuth fills the empty settings of the jump host from the host reached through it.
+func inheritAuth(jump config.SSH, conf config.SSH) config.SSH {
+	if jump.Config == "" {
+		jump.Config = conf.Config
+	}
+	if jump.KnownHosts == "" {
+		jump.KnownHosts = conf.KnownHosts
+		jump.TrustOnFirstUse = conf.TrustOnFirstUse
+		jump.InsecureIgnoreHostKey = conf.InsecureIgnoreHostKey
+	}
+	if !jump.Agent && len(jump.KeyFiles) == 0 && jump.Password == "" {
+		jump.Agent = conf.Agent
+		jump.KeyFiles = conf.KeyFiles
+		jump.Passphrase = conf.Passphrase
+	}
+	return jump
+}
+
+// parseJump parses the [user@]host[:port],... format of ssh -J.
+func parseJump(s string) ([]config.SSH, error) {
+	var jumps []config.SSH
+	for _, j := range strings.Split(s, ",") {
+		var jump config.SSH
+		if i := strings.LastIndex(j, "@"); i != -1 {
+			jump.User = j[:i]
+			j = j[i+1:]
+		}
+		jump.Host = j
+		if host, port, err := net.SplitHostPort(j); err == nil {
+			jump.Host = host
+			if jump.Port, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("invalid jump host port: %s", j)
+			}
+		}
+		if jump.Host == "" {
+			return nil, fmt.Errorf("invalid jump host: %s", s)
+		}
+		jumps = append(jumps, jump)
+	}
+	return jumps, nil
+}
+
+// sshFlags overrides the ssh config with the command flags.
+func sshFlags(conf *config.SSH, user string, host string, port int, identity string, jump string) error {
+	if user != "" {
+		conf.User = user
+	}
+	if host != "" {
+		conf.Host = host
+	}
+	if port != 0 {
+		conf.Port = port
+	}
+	if identity != "" {
+		conf.KeyFiles = []string{identity}
+	}
+	if jump != "" {
+		var err error
+		if conf.Jump, err = parseJump(jump); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newStorage returns the storage of the config, or the fanout of the storages when it has routes.
+func newStorage(ctx context.Context, conf *config.Config) (storage.Storage, error) {
+	if len(conf.Fanout) == 0 {
+		return newSink(ctx, conf, conf.Storage)
+	}
+	var routes []fanout.Route
+	stop := func() {
+		for _, r := range routes {
+			r.Storage.Stop(ctx)
+		}
+	}
+	used := make(map[string]bool)
+	for _, r := range conf.Fanout {
+		if used[r.Storage] {
+			stop()
+			return nil, fmt.Errorf("storage %s is used twice in fanout", r.Storage)
+		}
+		used[r.Storage] = true
+		s, err := newSink(ctx, conf, r.Storage)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		routes = append(routes, fanout.Route{
+			Name:      r.Storage,
+			Storage:   s,
+			Apps:      r.Apps,
+			Fields:    r.Fields,
+			QueueSize: r.QueueSize,
+			Timeout:   r.Timeout.Duration,
+		})
+	}
+	return fanout.New(routes), nil
+}
+
+// newSink returns the storage of the sink with its WAL.
+func newSink(ctx context.Context, conf *config.Config, name string) (storage.Storage, error) {
+	switch name {
+	case "loki", "influxdb", "elasticsearch", "clickhouse", "otlp":
+	case "ndjson":
+		return newFileSink(ctx, conf.Sinks.NDJSON, name)
+	case "logfmt":
+		return newFileSink(ctx, conf.Sinks.Logfmt, name)
+	case "parquet":
+		return newFileSink(ctx, conf.Sinks.Parquet, name)
+	default:
+		return nil, fmt.Errorf("unknown storage: %s", name)
+	}
+	w, err := openWAL(conf.WAL, name)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "loki":
+		c := conf.Sinks.Loki
+		return loki.New(xlog.FromContext(ctx), c.URL, c.BufferSize, c.BatchSize, c.BatchWait.Duration, newRetry(conf.Retry), w), nil
+	case "elasticsearch":
+		c := conf.Sinks.Elasticsearch
+		return elasticsearch.New(
+			xlog.FromContext(ctx),
+			elasticsearch.Config{
+				URL:         c.URL,
+				Username:    c.Username,
+				Password:    c.Password,
+				APIKey:      c.APIKey,
+				IndexPrefix: c.IndexPrefix,
+			},
+			c.BufferSize,
+			c.BatchSize,
+			c.BatchWait.Duration,
+			newRetry(conf.Retry),
+			w,
+		), nil
+	case "clickhouse":
+		c := conf.Sinks.ClickHouse
+		return clickhouse.New(
+			xlog.FromContext(ctx),
+			clickhouse.Config{
+				URL:      c.URL,
+				Username: c.Username,
+				Password: c.Password,
+				Database: c.Database,
+			},
+			c.BufferSize,
+			c.BatchSize,
+			c.BatchWait.Duration,
+			newRetry(conf.Retry),
+			w,
+		), nil
+	case "otlp":
+		c := conf.Sinks.OTLP
+		return otlp.New(
+			xlog.FromContext(ctx),
+			otlp.Config{
+				URL:     c.URL,
+				Headers: c.Headers,
+				Gzip:    c.Gzip,
+			},
+			c.BufferSize,
+			c.BatchSize,
+			c.BatchWait.Duration,
+			newRetry(conf.Retry),
+			w,
+		), nil
+	}
+	c := conf.Sinks.InfluxDB
+	if c.Version != 1 && c.Version != 2 {
+		if w != nil {
+			w.Close()
+		}
+		return nil, fmt.Errorf("unknown influxdb version: %d", c.Version)
+	}
+	if c.Version == 2 {
+		s, err := influxdb.NewV2(
+			xlog.FromContext(ctx),
+			influxdb.ConfigV2{
+				URL:       c.Addr,
+				Org:       c.Org,
+				Bucket:    c.Bucket,
+				Token:     c.Token,
+				Precision: c.Precision,
+				Gzip:      c.Gzip,
+			},
+			c.BufferSize,
+			c.BatchSize,
+			c.BatchWait.Duration,
+			newRetry(conf.Retry),
+			w,
+		)
+		if err != nil && w != nil {
+			w.Close()
+		}
+		return s, err
+	}
+	s, err := influxdb.New(
+		xlog.FromContext(ctx),
+		client.HTTPConfig{
+			Addr:     c.Addr,
+			Username: c.Username,
+			Password: c.Password,
+		},
+		c.Database,
+		c.BufferSize,
+		c.BatchSize,
+		c.BatchWait.Duration,
+		newRetry(conf.Retry),
+		w,
+	)
+	if err != nil && w != nil {
+		w.Close()
+	}
+	return s, err
+}
+
+// newFileSink returns the storage writing the files of the format, the files are written without a WAL.
+func newFileSink(ctx context.Context, c config.File, format string) (storage.Storage, error) {
+	return file.New(xlog.FromContext(ctx), file.Config{
+		Dir:         c.Dir,
+		Format:      format,
+		Compression: c.Compression,
+		MaxSize:     c.MaxSize,
+		MaxAge:      c.MaxAge.Duration,
+	})
+}
+
+// openWAL opens the WAL of the storage, it is nil when the WAL is disabled.
+func openWAL(conf config.WAL, name string) (*wal.WAL, error) {
+	if conf.Dir == "" {
+		return nil, nil
+	}
+	w, err := wal.Open(filepath.Join(conf.Dir, name), conf.SegmentSize, conf.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open wal: %w", err)
+	}
+	return w, nil
+}
+
+// stopTimeout is how long the queued lines are still written after an interruption.
+const stopTimeout = time.Minute
+
+// stopStorage stops the storage and logs its delivery counters.
+// The queued lines are written until stopTimeout when the context is already done.
+func stopStorage(ctx context.Context, store storage.Storage) error {
+	log := xlog.FromContext(ctx)
+	stopCtx := context.Background()
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		stopCtx, cancel = context.WithTimeout(stopCtx, stopTimeout)
+		defer cancel()
+	}
+	err := store.Stop(stopCtx)
+	s := store.Stats()
+	log.Infof("Delivered: %d, rejected: %d, failed: %d, failed writes: %d", s.Delivered, s.Rejected, s.Failed, s.Errors)
+	if err != nil {
+		log.Errorf("Storage: %s", err)
+	}
+	return err
+}
+
+func newRetry(conf config.Retry) retry.Policy {
+	return retry.Policy{
+		Attempts:   conf.Attempts,
+		Backoff:    conf.Backoff.Duration,
+		MaxBackoff: conf.MaxBackoff.Duration,
+		Jitter:     conf.Jitter,
+	}
+}
+
+// openDeadLetter opens the dead-letter file and sends the lines rejected by the storage into it.
+// It returns nil when the path is empty.
+func openDeadLetter(path string, store storage.Storage) (*deadletter.Writer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	w, err := deadletter.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open dead-letter file: %w", err)
+	}
+	if r, ok := store.(storage.Rejecter); ok {
+		r.OnReject(w.Reject)
+	}
+	return w, nil
+}
+
+// deadLetter writes the line which could not be sent into the dead-letter file, if there is one.
+func deadLetter(w *deadletter.Writer, log xlog.Logger, app string, origin storage.Origin, reason error) {
+	if w == nil {
+		return
+	}
+	err := w.Write(deadletter.Record{
+		Source: origin.Source,
+		App:    app,
+		File:   origin.File,
+		Line:   origin.Line,
+		Raw:    origin.Raw,
+		Reason: reason.Error(),
+	})
+	if err != nil {
+		log.Error("Unable to write dead-letter file: ", err)
+	}
+}
+
+func newParsers(conf *config.Config, apps []string) (map[string]parser.Parser, error) {
+	var err error
+	parsers := make(map[string]parser.Parser)
+	for _, app := range apps {
+		if parsers[app], err = parser.New(conf.AppParser(app)); err != nil {
+			return nil, fmt.Errorf("unable to create parser of %s: %w", app, err)
+		}
+	}
+	return parsers, nil
+}
+
+// processLine sends the parsed raw line of the origin to the storage, tagged with the source it was collected from.
+func processLine(ctx context.Context, store storage.Storage, p parser.Parser, origin storage.Origin, app string) error {
+	ll, err := p.Parse(origin.Raw)
+	if err != nil {
+		return err
+	}
+	if ll.App == "" {
+		ll.App = app
+	}
+	if ll.Tags == nil {
+		ll.Tags = make(map[string]string)
+	}
+	ll.Tags["source"] = origin.Source
+	ll.Origin = origin
+	return store.Send(ctx, ll)
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDay returns the midnight of the day given as 20060102, 2006-01-02, today, yesterday or -7d relative to now.
+func parseDay(s string, now time.Time) (time.Time, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	switch s {
+	case "today":
+		return today, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+	if strings.HasPrefix(s, "-") && strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(s[1 : len(s)-1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid relative day: %s", s)
+		}
+		return today.AddDate(0, 0, -days), nil
+	}
+	for _, layout := range []string{"20060102", "2006-01-02"} {
+		if day, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return day, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid day: %s", s)
+}
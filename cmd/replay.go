@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/deadletter"
+	"github.com/Ak-Army/logcollector/internal/parser"
+	"github.com/Ak-Army/logcollector/internal/storage"
+
+	"github.com/Ak-Army/cli"
+	"github.com/Ak-Army/xlog"
+	"github.com/sgreben/flagvar"
+)
+
+func init() {
+	cli.RootCommand().AddCommand("replay-dlq", &ReplayDLQ{})
+}
+
+type ReplayDLQ struct {
+	Config  string          `flag:"config, config file (yaml or toml)"`
+	File    string          `flag:"file, dead-letter file, the dead_letter of the config by default"`
+	Apps    flagvar.Strings `flag:"apps, replay only the lines of these apps"`
+	Loki    bool            `flag:"loki, send data to loki"`
+	conf    *config.Config
+	parsers map[string]parser.Parser
+}
+
+func (r ReplayDLQ) Help() string {
+	return `Usage: log-collector replay-dlq [command options]
+
+Parses and sends the lines of the dead-letter file again, e.g. after a parser fix.
+The lines failing again are kept in the file, the others are removed from it.
+Do not run it while collect or tail writes the same file.`
+}
+
+func (r ReplayDLQ) Synopsis() string {
+	return "Ship the lines of the dead-letter file again"
+}
+
+func (r ReplayDLQ) Run(ctx context.Context) error {
+	return fail(r.run(ctx))
+}
+
+func (r ReplayDLQ) run(ctx context.Context) error {
+	var err error
+	if r.conf, err = config.Load(r.Config); err != nil {
+		return err
+	}
+	if r.Loki {
+		r.conf.Storage = "loki"
+	}
+	if r.File == "" {
+		r.File = r.conf.DeadLetter
+	}
+	if r.File == "" {
+		return errors.New("no dead-letter file")
+	}
+	if _, err := os.Stat(r.File); err != nil {
+		return err
+	}
+	log := xlog.FromContext(ctx)
+	r.parsers = make(map[string]parser.Parser)
+	store, err := newStorage(ctx, r.conf)
+	if err != nil {
+		return err
+	}
+	next := r.File + ".replay"
+	os.Remove(next)
+	failed, err := openDeadLetter(next, store)
+	if err != nil {
+		store.Stop(ctx)
+		return err
+	}
+	replayed := 0
+	err = deadletter.Read(r.File, func(rec deadletter.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !r.replays(rec.App) {
+			return failed.Write(rec)
+		}
+		if err := r.replay(ctx, store, rec); err != nil {
+			rec.Time = time.Time{}
+			rec.Reason = err.Error()
+			return failed.Write(rec)
+		}
+		replayed++
+		return nil
+	})
+	if stopErr := stopStorage(ctx, store); err == nil {
+		err = stopErr
+	}
+	failed.Close()
+	if err != nil {
+		os.Remove(next)
+		return fmt.Errorf("replay stopped, %s is not changed, %d lines were sent: %w", r.File, replayed, err)
+	}
+	log.Infof("Replayed: %d, failed: %d", replayed, failed.Written())
+	if failed.Written() == 0 {
+		os.Remove(next)
+		return os.Remove(r.File)
+	}
+	if err := os.Rename(next, r.File); err != nil {
+		return err
+	}
+	return fmt.Errorf("%d lines are still in %s", failed.Written(), r.File)
+}
+
+func (r ReplayDLQ) replays(app string) bool {
+	if len(r.Apps.Values) == 0 {
+		return true
+	}
+	for _, a := range r.Apps.Values {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ReplayDLQ) replay(ctx context.Context, store storage.Storage, rec deadletter.Record) error {
+	p, ok := r.parsers[rec.App]
+	if !ok {
+		var err error
+		if p, err = parser.New(r.conf.AppParser(rec.App)); err != nil {
+			return fmt.Errorf("unable to create parser of %s: %w", rec.App, err)
+		}
+		r.parsers[rec.App] = p
+	}
+	origin := storage.Origin{
+		Source: rec.Source,
+		File:   rec.File,
+		Line:   rec.Line,
+		Raw:    rec.Raw,
+	}
+	return processLine(ctx, store, p, origin, rec.App)
+}
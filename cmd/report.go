@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Ak-Army/xlog"
+)
+
+// maxReportedLines is the number of unparseable lines kept for the report, the rest is only counted.
+const maxReportedLines = 100
+
+// report collects what could not be shipped, it is logged at the end of the run.
+type report struct {
+	lock        sync.Mutex
+	files       []failure
+	lines       []failure
+	failedLines int
+}
+
+type failure struct {
+	path string
+	line int
+	raw  string
+	err  error
+}
+
+// fail records a file which could not be shipped.
+func (r *report) fail(path string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.files = append(r.files, failure{path: path, err: err})
+}
+
+// failLine records a line which could not be parsed or sent.
+func (r *report) failLine(path string, line int, raw string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failedLines++
+	if len(r.lines) < maxReportedLines {
+		r.lines = append(r.lines, failure{path: path, line: line, raw: raw, err: err})
+	}
+}
+
+func (r *report) log(log xlog.Logger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, f := range r.files {
+		log.Errorf("Failed: %s: %s", f.path, f.err)
+	}
+	for _, l := range r.lines {
+		log.Errorf("Failed line %s:%d: %s: %q", l.path, l.line, l.err, l.raw)
+	}
+	if r.failedLines > len(r.lines) {
+		log.Errorf("Failed lines not listed: %d", r.failedLines-len(r.lines))
+	}
+}
+
+// err returns an error when anything failed.
+func (r *report) err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.files) == 0 && r.failedLines == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d files and %d lines failed", len(r.files), r.failedLines)
+}
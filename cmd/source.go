@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/source"
+	"github.com/Ak-Army/logcollector/internal/ssh_client"
+)
+
+// logSource is a syslog server reached through its own ssh connection, the local disk or an s3 archive.
+type logSource struct {
+	name    string
+	named   bool
+	root    string
+	path    source.Template
+	servers []string
+	apps    []string
+	// local files are parsed in place, they are not downloaded.
+	local  bool
+	client source.Source
+}
+
+// newSources connects the sources of the config, servers overrides the servers of every source.
+// The ssh connections are retried until ctx is done.
+func newSources(ctx context.Context, conf *config.Config, servers []string) ([]*logSource, error) {
+	var sources []*logSource
+	for _, s := range conf.SourceList() {
+		src := &logSource{
+			name:    s.Name,
+			named:   s.Name != "",
+			root:    s.Root,
+			path:    source.Template(s.Path),
+			servers: s.Servers,
+			apps:    s.Apps,
+		}
+		var err error
+		switch s.Type {
+		case "local":
+			src.local = true
+			src.client = source.Local{}
+			if !src.named {
+				src.name, err = os.Hostname()
+			}
+		case "ssh", "":
+			var client *ssh_client.SSHClient
+			if client, err = newSSHClient(s.SSH); err == nil {
+				client.Retry = newRetry(conf.Retry)
+				client.Ctx = ctx
+				src.client = client
+			}
+			if !src.named {
+				src.name = s.SSH.Host
+			}
+		case "s3":
+			src.client = newS3(s.S3)
+			if !src.named {
+				src.name = s.S3.Bucket
+			}
+		default:
+			err = fmt.Errorf("unknown source type: %s", s.Type)
+		}
+		if err != nil {
+			closeSources(sources)
+			return nil, err
+		}
+		if len(servers) != 0 {
+			src.servers = servers
+		}
+		if len(src.servers) == 0 {
+			src.servers = []string{"*"}
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+func newS3(conf config.S3) *source.S3 {
+	s3 := &source.S3{
+		Endpoint:  conf.Endpoint,
+		Region:    conf.Region,
+		Bucket:    conf.Bucket,
+		AccessKey: conf.AccessKey,
+		SecretKey: conf.SecretKey,
+	}
+	if s3.Endpoint == "" {
+		s3.Endpoint = "https://s3.amazonaws.com"
+		if s3.Region != "" {
+			s3.Endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+		}
+	}
+	if s3.AccessKey == "" {
+		s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return s3
+}
+
+func closeSources(sources []*logSource) {
+	for _, s := range sources {
+		s.client.Close()
+	}
+}
+
+// collects reports whether the app is collected from the source.
+func (s *logSource) collects(app string) bool {
+	if len(s.apps) == 0 {
+		return true
+	}
+	for _, a := range s.apps {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
+
+// glob returns the files of the app on the given day of every server.
+func (s *logSource) glob(date time.Time, app string) ([]string, error) {
+	var paths []string
+	for _, server := range s.servers {
+		matches, err := s.client.Glob(s.path.Path(s.root, server, date, app))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// serverPrefix returns the beginning of the paths of the server.
+func (s *logSource) serverPrefix(server string) string {
+	return s.path.ServerPrefix(s.root, server)
+}
+
+// key is the state key of the path, prefixed with the name of an explicitly named source.
+func (s *logSource) key(path string) string {
+	if !s.named {
+		return path
+	}
+	return s.name + ":" + path
+}
+
+// localCopy is the name of the local copy of the path.
+func (s *logSource) localCopy(path string) string {
+	local := strings.Replace(strings.Trim(path, "/"), "/", "_", -1)
+	if s.named {
+		local = s.name + "_" + local
+	}
+	return local
+}
@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/deadletter"
+	"github.com/Ak-Army/logcollector/internal/decompress"
+	"github.com/Ak-Army/logcollector/internal/parser"
+	"github.com/Ak-Army/logcollector/internal/state"
+	"github.com/Ak-Army/logcollector/internal/storage"
+
+	"github.com/Ak-Army/cli"
+	"github.com/Ak-Army/xlog"
+	"github.com/sgreben/flagvar"
+)
+
+func init() {
+	cli.RootCommand().AddCommand("tail", &Tail{})
+}
+
+type Tail struct {
+	Config     string          `flag:"config, config file (yaml or toml)"`
+	Apps       flagvar.Strings `flag:"apps, app name"`
+	Servers    flagvar.Strings `flag:"servers, server name, overrides the servers of every source"`
+	Loki       bool            `flag:"loki, send data to loki"`
+	Local      bool            `flag:"local, read the sources without type from the local disk instead of ssh"`
+	Interval   string          `flag:"interval, poll interval of the remote files, default 2s"`
+	User       string          `flag:"user, ssh user"`
+	Host       string          `flag:"host, syslog server of the sources without host, can be a Host of the ssh config"`
+	Port       int             `flag:"port, ssh port"`
+	Identity   string          `flag:"identity, ssh private key file"`
+	Jump       string          `flag:"jump, jump hosts like ssh -J: [user@]host[:port],..."`
+	State      string          `flag:"state, state file of the shipped files, the followed files are resumed from it"`
+	DeadLetter string          `flag:"dead-letter, file of the lines which could not be parsed or were rejected"`
+	WAL        string          `flag:"wal, directory of the write-ahead log of the storage"`
+	conf       *config.Config
+	sources    []*logSource
+	store      storage.Storage
+	state      *state.Store
+	deadLetter *deadletter.Writer
+	parsers    map[string]parser.Parser
+	files      map[string]*tailFile
+}
+
+// tailFile is a remote file followed by the tail command.
+type tailFile struct {
+	src  *logSource
+	path string
+	app  string
+	date string
+	// offset is the end of the last complete line sent, saved is the offset in the state file.
+	offset int64
+	saved  int64
+	// head is the sha256 of the first line, it is empty until the first line is complete.
+	head    string
+	size    int64
+	modTime time.Time
+}
+
+func (t Tail) Help() string {
+	return `Usage: log-collector tail [command options]`
+}
+
+func (t Tail) Synopsis() string {
+	return "Ship the logs of today continuously"
+}
+
+func (t Tail) Run(ctx context.Context) error {
+	return fail(t.run(ctx))
+}
+
+func (t Tail) run(ctx context.Context) error {
+	var err error
+	if t.conf, err = config.Load(t.Config); err != nil {
+		return err
+	}
+	if t.Loki {
+		t.conf.Storage = "loki"
+	}
+	if t.DeadLetter != "" {
+		t.conf.DeadLetter = t.DeadLetter
+	}
+	if t.WAL != "" {
+		t.conf.WAL.Dir = t.WAL
+	}
+	if t.Local {
+		t.conf.Source.Type = "local"
+	}
+	if t.State != "" {
+		t.conf.State = t.State
+	}
+	if t.conf.State != "" {
+		if t.state, err = state.Open(t.conf.State); err != nil {
+			return fmt.Errorf("unable to open state file: %w", err)
+		}
+	}
+	if len(t.Apps.Values) == 0 {
+		t.Apps.Values = t.conf.Source.Apps
+	}
+	interval := 2 * time.Second
+	if t.Interval != "" {
+		if interval, err = time.ParseDuration(t.Interval); err != nil {
+			return err
+		}
+	}
+	if t.parsers, err = newParsers(t.conf, t.Apps.Values); err != nil {
+		return err
+	}
+	if err := sshFlags(&t.conf.SSH, t.User, t.Host, t.Port, t.Identity, t.Jump); err != nil {
+		return err
+	}
+	if t.sources, err = newSources(ctx, t.conf, t.Servers.Values); err != nil {
+		return err
+	}
+	defer closeSources(t.sources)
+	if t.store, err = newStorage(ctx, t.conf); err != nil {
+		return err
+	}
+	if t.deadLetter, err = openDeadLetter(t.conf.DeadLetter, t.store); err != nil {
+		t.store.Stop(ctx)
+		return err
+	}
+	if t.deadLetter != nil {
+		defer t.deadLetter.Close()
+	}
+	t.files = make(map[string]*tailFile)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	log := xlog.FromContext(ctx)
+	for {
+		t.poll(ctx)
+		err := t.store.Flush(ctx)
+		switch {
+		case err == nil:
+			t.save(log)
+		case errors.Is(err, storage.ErrPending):
+		case ctx.Err() == nil:
+			log.Errorf("Unable to deliver: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			err := stopStorage(ctx, t.store)
+			if err == nil {
+				t.save(log)
+			}
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// save saves the offsets of the followed files after the storage wrote their lines,
+// the lines after the saved offsets are shipped again by the next run.
+func (t Tail) save(log xlog.Logger) {
+	if t.state == nil {
+		return
+	}
+	for key, f := range t.files {
+		if f.offset == f.saved {
+			continue
+		}
+		st := state.File{
+			Size:    f.size,
+			ModTime: f.modTime,
+			Offset:  f.offset,
+			Head:    f.head,
+		}
+		if err := t.state.Set(key, st); err != nil {
+			log.Error("Unable to save state: ", err)
+			continue
+		}
+		f.saved = f.offset
+	}
+}
+
+// poll ships the new lines of the followed files and starts following the new files of today.
+// Files of the previous days are followed until they stop growing.
+func (t Tail) poll(ctx context.Context) {
+	log := xlog.FromContext(ctx)
+	now := time.Now()
+	date := now.Format("20060102")
+	for _, src := range t.sources {
+		for _, app := range t.Apps.Values {
+			if !src.collects(app) {
+				continue
+			}
+			paths, err := src.glob(now, app)
+			if err != nil {
+				log.Errorf("Unable to list files of %s on %s: %s", app, src.name, err)
+				src.client.Close()
+				break
+			}
+			for _, path := range paths {
+				key := src.key(path)
+				if _, ok := t.files[key]; ok || decompress.Compressed(path) {
+					continue
+				}
+				f := &tailFile{src: src, path: path, app: app, date: date}
+				if t.state != nil {
+					if st, ok := t.state.Get(key); ok {
+						f.offset, f.saved, f.head = st.Offset, st.Offset, st.Head
+					}
+				}
+				log.Infof("Follow from %d: %s", f.offset, key)
+				t.files[key] = f
+			}
+		}
+	}
+	for key, f := range t.files {
+		grown, err := t.follow(ctx, f)
+		if err != nil {
+			log.Errorf("Unable to follow %s: %s", key, err)
+			if os.IsNotExist(err) {
+				delete(t.files, key)
+			}
+			continue
+		}
+		if !grown && f.date != date {
+			log.Infof("Stop following: %s", key)
+			delete(t.files, key)
+		}
+	}
+}
+
+// follow sends the complete lines appended to the file since the last poll.
+// The file was truncated or rotated when it is smaller than the offset or its first line changed, it is read from the beginning.
+func (t Tail) follow(ctx context.Context, f *tailFile) (bool, error) {
+	log := xlog.FromContext(ctx)
+	info, err := f.src.client.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == f.offset {
+		return false, nil
+	}
+	f.size = info.Size()
+	f.modTime = info.ModTime()
+	rotated := info.Size() < f.offset
+	if !rotated && f.offset > 0 {
+		head, err := t.head(f)
+		if err != nil {
+			return false, err
+		}
+		if f.head == "" {
+			// resumed from the state of the collect command
+			f.head = head
+		}
+		rotated = head != f.head
+	}
+	if rotated {
+		log.Infof("File truncated or rotated, read from the beginning: %s", f.path)
+		f.offset = 0
+		f.head = ""
+	}
+	r, err := f.src.client.Open(f.path, f.offset)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	var n int64
+	scanner := newLineScanner(r, &n, false)
+	grown := false
+	for scanner.Scan() {
+		grown = true
+		origin := storage.Origin{
+			Source: f.src.name,
+			File:   f.path,
+			Raw:    scanner.Text(),
+		}
+		if err := processLine(ctx, t.store, t.parsers[f.app], origin, f.app); err != nil {
+			if ctx.Err() != nil {
+				return true, ctx.Err()
+			}
+			log.Error(err)
+			deadLetter(t.deadLetter, log, f.app, origin, err)
+		}
+		if f.offset == 0 {
+			f.head = lineHash(scanner.Bytes())
+		}
+		f.offset += n
+	}
+	return grown, scanner.Err()
+}
+
+// head returns the hash of the first line of the file, it is empty while the first line is not complete.
+func (t Tail) head(f *tailFile) (string, error) {
+	r, err := f.src.client.Open(f.path, 0)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	var n int64
+	scanner := newLineScanner(r, &n, false)
+	if !scanner.Scan() {
+		return "", scanner.Err()
+	}
+	return lineHash(scanner.Bytes()), nil
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
@@ -6,13 +6,19 @@ require (
 	github.com/Ak-Army/cli v1.0.0
 	github.com/Ak-Army/httpClient v0.0.0-20210130131717-6e6386598a5e
 	github.com/Ak-Army/xlog v1.1.0
+	github.com/BurntSushi/toml v0.3.1
 	github.com/go-logfmt/logfmt v0.4.0
 	github.com/gogo/protobuf v1.3.1
 	github.com/golang/protobuf v1.3.2
 	github.com/golang/snappy v0.0.1
 	github.com/influxdata/influxdb1-client v0.0.0-20200827194710-b269163b24ab
+	github.com/kevinburke/ssh_config v0.0.0-20201106050909-4977a11b4351
+	github.com/klauspost/compress v1.11.7
+	github.com/pkg/sftp v1.11.0
 	github.com/sgreben/flagvar v1.10.1
 	github.com/uber-go/atomic v1.3.2
+	github.com/ulikunitz/xz v0.5.10
 	go.uber.org/atomic v1.7.0
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	gopkg.in/yaml.v2 v2.3.0
 )
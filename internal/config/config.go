@@ -0,0 +1,475 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	SSH    SSH    `yaml:"ssh" toml:"ssh"`
+	Source Source `yaml:"source" toml:"source"`
+	// Sources are the syslog servers to collect from, ssh and source are used when it is empty.
+	Sources  []Source          `yaml:"sources" toml:"sources"`
+	Parser   Parser            `yaml:"parser" toml:"parser"`
+	Parsers  map[string]Parser `yaml:"parsers" toml:"parsers"`
+	Storage  string            `yaml:"storage" toml:"storage"`
+	Sinks    Sinks             `yaml:"sinks" toml:"sinks"`
+	Pipeline Pipeline          `yaml:"pipeline" toml:"pipeline"`
+	// Fanout sends the lines to several storages, storage is used when it is empty.
+	Fanout []Route `yaml:"fanout" toml:"fanout"`
+	// WAL keeps the lines waiting for the storage on the disk.
+	WAL WAL `yaml:"wal" toml:"wal"`
+	// Retry is used for the downloads, the sink writes and the ssh commands.
+	Retry Retry `yaml:"retry" toml:"retry"`
+	// State is the file recording the shipped files, empty disables it.
+	State string `yaml:"state" toml:"state"`
+	// DeadLetter is the NDJSON file of the lines which could not be parsed or were rejected by the storage,
+	// empty disables it.
+	DeadLetter string `yaml:"dead_letter" toml:"dead_letter"`
+}
+
+type SSH struct {
+	// Host can be an alias of the ssh config file, empty user, port and key files are taken from its Host entry.
+	User       string   `yaml:"user" toml:"user"`
+	Host       string   `yaml:"host" toml:"host"`
+	Port       int      `yaml:"port" toml:"port"`
+	Config     string   `yaml:"config" toml:"config"`
+	Agent      bool     `yaml:"agent" toml:"agent"`
+	KeyFiles   []string `yaml:"key_files" toml:"key_files"`
+	Passphrase string   `yaml:"passphrase" toml:"passphrase"`
+	Password   string   `yaml:"password" toml:"password"`
+	KnownHosts string   `yaml:"known_hosts" toml:"known_hosts"`
+	// TrustOnFirstUse adds the host key of an unknown host to the known hosts file.
+	TrustOnFirstUse       bool `yaml:"trust_on_first_use" toml:"trust_on_first_use"`
+	InsecureIgnoreHostKey bool `yaml:"insecure_ignore_host_key" toml:"insecure_ignore_host_key"`
+	// Jump hosts are used in order to reach the host, their empty auth settings are inherited.
+	// The ProxyJump of the ssh config is used when it is empty.
+	Jump []SSH `yaml:"jump" toml:"jump"`
+}
+
+type Source struct {
+	// Name is the source tag of the log lines, the ssh host, the local host name or the bucket by default.
+	Name string `yaml:"name" toml:"name"`
+	// Type is ssh, local or s3, local reads the files from the local disk.
+	Type string `yaml:"type" toml:"type"`
+	// SSH settings of the source, the empty ones are taken from the top-level ssh.
+	SSH SSH `yaml:"ssh" toml:"ssh"`
+	// S3 is the bucket of the s3 source, the paths are the object keys.
+	S3   S3     `yaml:"s3" toml:"s3"`
+	Root string `yaml:"root" toml:"root"`
+	// Path is the remote glob of the log files, {root}, {server}, {date}, {date:<layout>} and {app} are replaced.
+	Path    string   `yaml:"path" toml:"path"`
+	Servers []string `yaml:"servers" toml:"servers"`
+	// Apps limits the apps collected from the source, the top-level apps are the apps to collect.
+	Apps []string `yaml:"apps" toml:"apps"`
+}
+
+type S3 struct {
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	Region   string `yaml:"region" toml:"region"`
+	Bucket   string `yaml:"bucket" toml:"bucket"`
+	// AccessKey and SecretKey are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY when empty.
+	AccessKey string `yaml:"access_key" toml:"access_key"`
+	SecretKey string `yaml:"secret_key" toml:"secret_key"`
+}
+
+type Parser struct {
+	// Type is the name of a registered parser: syslog, json, regexp or nginx.
+	Type string `yaml:"type" toml:"type"`
+	// Syslog strips the "<time> <host> <app>[pid]:" prefix before parsing the message.
+	// The syslog parser always does it.
+	Syslog bool `yaml:"syslog" toml:"syslog"`
+	// Pattern is the regular expression with named groups of the regexp parser.
+	Pattern string `yaml:"pattern" toml:"pattern"`
+	// TimeKey holds the time of the log line, parsed with TimeLayout.
+	TimeKey    string `yaml:"time_key" toml:"time_key"`
+	TimeLayout string `yaml:"time_layout" toml:"time_layout"`
+	// Replace rewrites the message before it is parsed.
+	Replace []Replace `yaml:"replace" toml:"replace"`
+	// Drop keys are not stored at all.
+	Drop []string `yaml:"drop" toml:"drop"`
+	// Strings keys are stored as string fields without type conversion.
+	Strings []string `yaml:"strings" toml:"strings"`
+	// Tags maps a logfmt key to the tag name it is stored under.
+	Tags map[string]string `yaml:"tags" toml:"tags"`
+	// Expand keys have a "Name{key=value, ...}" value whose numeric values are stored as fields too.
+	Expand []string `yaml:"expand" toml:"expand"`
+}
+
+type Replace struct {
+	Pattern string `yaml:"pattern" toml:"pattern"`
+	With    string `yaml:"with" toml:"with"`
+}
+
+type Pipeline struct {
+	// Stream parses the remote files while they are read instead of downloading them first.
+	Stream bool `yaml:"stream" toml:"stream"`
+	// DownloadWorkers download or stream the files in parallel.
+	DownloadWorkers int `yaml:"download_workers" toml:"download_workers"`
+	// ParseWorkers parse the downloaded files in parallel.
+	ParseWorkers int `yaml:"parse_workers" toml:"parse_workers"`
+	// QueueSize is the number of files waiting for a download or a parse worker.
+	QueueSize int `yaml:"queue_size" toml:"queue_size"`
+}
+
+type WAL struct {
+	// Dir has a directory per storage, empty disables the WAL.
+	Dir string `yaml:"dir" toml:"dir"`
+	// SegmentSize is the size of the segment files in bytes.
+	SegmentSize int64 `yaml:"segment_size" toml:"segment_size"`
+	// MaxSize in bytes blocks the collection while the storage is not able to catch up, 0 means no limit.
+	MaxSize int64 `yaml:"max_size" toml:"max_size"`
+}
+
+type Retry struct {
+	// Attempts is the maximum number of tries, 1 disables retrying.
+	Attempts   int      `yaml:"attempts" toml:"attempts"`
+	Backoff    Duration `yaml:"backoff" toml:"backoff"`
+	MaxBackoff Duration `yaml:"max_backoff" toml:"max_backoff"`
+	// Jitter randomizes the backoff by the given fraction of it.
+	Jitter float64 `yaml:"jitter" toml:"jitter"`
+}
+
+type Sinks struct {
+	Loki          Loki          `yaml:"loki" toml:"loki"`
+	InfluxDB      InfluxDB      `yaml:"influxdb" toml:"influxdb"`
+	Elasticsearch Elasticsearch `yaml:"elasticsearch" toml:"elasticsearch"`
+	ClickHouse    ClickHouse    `yaml:"clickhouse" toml:"clickhouse"`
+	OTLP          OTLP          `yaml:"otlp" toml:"otlp"`
+	NDJSON        File          `yaml:"ndjson" toml:"ndjson"`
+	Logfmt        File          `yaml:"logfmt" toml:"logfmt"`
+	Parquet       File          `yaml:"parquet" toml:"parquet"`
+}
+
+// Route sends the lines of the apps to a storage configured in sinks.
+type Route struct {
+	// Storage is the name of the sink, it can be used only once.
+	Storage string `yaml:"storage" toml:"storage"`
+	// Apps sent to the storage, all of them when empty.
+	Apps []string `yaml:"apps" toml:"apps"`
+	// Fields kept in the lines, all of them when empty. Loki sends the raw field as the log line.
+	Fields []string `yaml:"fields" toml:"fields"`
+	// QueueSize is the number of lines waiting for the storage, so a slow storage does not stall the others.
+	QueueSize int `yaml:"queue_size" toml:"queue_size"`
+	// Timeout is how long a line waits for the full queue, then it is rejected for this storage, 0 waits.
+	Timeout Duration `yaml:"timeout" toml:"timeout"`
+}
+
+type Loki struct {
+	URL        string   `yaml:"url" toml:"url"`
+	BufferSize int      `yaml:"buffer_size" toml:"buffer_size"`
+	BatchSize  int      `yaml:"batch_size" toml:"batch_size"`
+	BatchWait  Duration `yaml:"batch_wait" toml:"batch_wait"`
+}
+
+// InfluxDB is used with the 1.x API by default, the 2.x API writes into the bucket of the org with the token.
+type InfluxDB struct {
+	// Version of the API: 1 or 2.
+	Version  int    `yaml:"version" toml:"version"`
+	Addr     string `yaml:"addr" toml:"addr"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	Database string `yaml:"database" toml:"database"`
+	Org      string `yaml:"org" toml:"org"`
+	Bucket   string `yaml:"bucket" toml:"bucket"`
+	Token    string `yaml:"token" toml:"token"`
+	// Precision of the timestamps written with the 2.x API: ns, us, ms or s.
+	Precision string `yaml:"precision" toml:"precision"`
+	// Gzip compresses the lines written with the 2.x API.
+	Gzip       bool     `yaml:"gzip" toml:"gzip"`
+	BufferSize int      `yaml:"buffer_size" toml:"buffer_size"`
+	BatchSize  int      `yaml:"batch_size" toml:"batch_size"`
+	BatchWait  Duration `yaml:"batch_wait" toml:"batch_wait"`
+}
+
+// Elasticsearch works with OpenSearch too, the lines are written into daily indices per app.
+type Elasticsearch struct {
+	URL      string `yaml:"url" toml:"url"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	// APIKey is used instead of the username and password when it is set.
+	APIKey string `yaml:"api_key" toml:"api_key"`
+	// IndexPrefix of the indices, they are named prefix + app + "-2006.01.02".
+	IndexPrefix string   `yaml:"index_prefix" toml:"index_prefix"`
+	BufferSize  int      `yaml:"buffer_size" toml:"buffer_size"`
+	BatchSize   int      `yaml:"batch_size" toml:"batch_size"`
+	BatchWait   Duration `yaml:"batch_wait" toml:"batch_wait"`
+}
+
+// ClickHouse is used over its HTTP interface, the lines are written into a table per app.
+type ClickHouse struct {
+	URL        string   `yaml:"url" toml:"url"`
+	Username   string   `yaml:"username" toml:"username"`
+	Password   string   `yaml:"password" toml:"password"`
+	Database   string   `yaml:"database" toml:"database"`
+	BufferSize int      `yaml:"buffer_size" toml:"buffer_size"`
+	BatchSize  int      `yaml:"batch_size" toml:"batch_size"`
+	BatchWait  Duration `yaml:"batch_wait" toml:"batch_wait"`
+}
+
+// OTLP exports the lines as log records over HTTP, the app is the service.name of the resource.
+type OTLP struct {
+	// URL of the collector, the logs are posted to URL/v1/logs.
+	URL string `yaml:"url" toml:"url"`
+	// Headers of the requests, like the authorization.
+	Headers    map[string]string `yaml:"headers" toml:"headers"`
+	Gzip       bool              `yaml:"gzip" toml:"gzip"`
+	BufferSize int               `yaml:"buffer_size" toml:"buffer_size"`
+	BatchSize  int               `yaml:"batch_size" toml:"batch_size"`
+	BatchWait  Duration          `yaml:"batch_wait" toml:"batch_wait"`
+}
+
+// File writes the lines into a file per app and day named dir/app/2006-01-02.N with the extension of the format.
+type File struct {
+	Dir string `yaml:"dir" toml:"dir"`
+	// Compression is gzip, zstd or none, the pages of the parquet files can be compressed with snappy too.
+	Compression string `yaml:"compression" toml:"compression"`
+	// MaxSize of the uncompressed content of a file, a new file is started after it, 0 means no limit.
+	MaxSize int64 `yaml:"max_size" toml:"max_size"`
+	// MaxAge of a file, a new file is started after it, 0 means no limit.
+	MaxAge Duration `yaml:"max_age" toml:"max_age"`
+}
+
+// Duration is a time.Duration which can be written as "5s" in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Default returns the configuration used when no config file is given.
+func Default() *Config {
+	return &Config{
+		SSH: SSH{
+			Host:       "syslog-server",
+			Config:     "~/.ssh/config",
+			Agent:      true,
+			KnownHosts: "~/.ssh/known_hosts",
+		},
+		Source: Source{
+			Type: "ssh",
+			Root: "/var/log/remote",
+			Path: "{root}/{server}/{date}/{app}/*",
+		},
+		Parser: Parser{
+			Type:       "syslog",
+			TimeKey:    "time",
+			TimeLayout: "2006-01-02 15:04:05.999999999 -0700 MST",
+			Replace: []Replace{
+				{Pattern: `^(.*) requestBody=".*" (serveTime.*)$`, With: "$1 $2"},
+			},
+			Drop:    []string{"requestBody"},
+			Strings: []string{"customer", "phone", "op", "secondaryProj", "queueId", "userName", "mode"},
+			Tags: map[string]string{
+				"method": "method_topic",
+				"topic":  "method_topic",
+			},
+			Expand: []string{"stat"},
+		},
+		Pipeline: Pipeline{
+			DownloadWorkers: 2,
+			ParseWorkers:    2,
+			QueueSize:       10,
+		},
+		WAL: WAL{
+			SegmentSize: 64 << 20,
+			MaxSize:     1 << 30,
+		},
+		Retry: Retry{
+			Attempts:   5,
+			Backoff:    Duration{time.Second},
+			MaxBackoff: Duration{30 * time.Second},
+			Jitter:     0.2,
+		},
+		Storage: "influxdb",
+		Sinks: Sinks{
+			Loki: Loki{
+				URL:        "http://localhost:3100",
+				BufferSize: 1000,
+				BatchSize:  2000000,
+				BatchWait:  Duration{5 * time.Second},
+			},
+			InfluxDB: InfluxDB{
+				Version:    1,
+				Addr:       "http://localhost:8086",
+				Database:   "log",
+				Bucket:     "log",
+				Precision:  "ns",
+				Gzip:       true,
+				BufferSize: 1000,
+				BatchSize:  10000000,
+				BatchWait:  Duration{5 * time.Second},
+			},
+			Elasticsearch: Elasticsearch{
+				URL:         "http://localhost:9200",
+				IndexPrefix: "logcollector-",
+				BufferSize:  1000,
+				BatchSize:   5000000,
+				BatchWait:   Duration{5 * time.Second},
+			},
+			ClickHouse: ClickHouse{
+				URL:        "http://localhost:8123",
+				Username:   "default",
+				Database:   "log",
+				BufferSize: 1000,
+				BatchSize:  10000000,
+				BatchWait:  Duration{5 * time.Second},
+			},
+			OTLP: OTLP{
+				URL:        "http://localhost:4318",
+				Gzip:       true,
+				BufferSize: 1000,
+				BatchSize:  5000000,
+				BatchWait:  Duration{5 * time.Second},
+			},
+			NDJSON: File{
+				Dir:         "export",
+				Compression: "gzip",
+				MaxSize:     256 << 20,
+			},
+			Logfmt: File{
+				Dir:         "export",
+				Compression: "gzip",
+				MaxSize:     256 << 20,
+			},
+			Parquet: File{
+				Dir:         "export",
+				Compression: "snappy",
+				MaxSize:     128 << 20,
+				MaxAge:      Duration{time.Hour},
+			},
+		},
+	}
+}
+
+// Load reads the config file over the defaults, the format is chosen by the file extension.
+// The maps of the file replace the default ones instead of being merged into them.
+func Load(path string) (*Config, error) {
+	conf := Default()
+	if path == "" {
+		return conf, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// the file is decoded on an empty config too, it tells the maps set by the file
+	file := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		// the unknown keys are refused like the strict yaml does
+		var meta toml.MetaData
+		if meta, err = toml.Decode(string(data), file); err == nil {
+			if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+				keys := make([]string, len(undecoded))
+				for i, key := range undecoded {
+					keys[i] = key.String()
+				}
+				err = fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+			}
+		}
+		if err == nil {
+			_, err = toml.Decode(string(data), conf)
+		}
+	case ".yml", ".yaml":
+		// the strict decoding refuses the keys of the default maps, so it is done on the empty config
+		if err = yaml.UnmarshalStrict(data, file); err == nil {
+			err = yaml.Unmarshal(data, conf)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config %s: %w", path, err)
+	}
+	if file.Parser.Tags != nil {
+		conf.Parser.Tags = file.Parser.Tags
+	}
+	return conf, nil
+}
+
+// AppParser returns the parser config of the app, the default parser is used when it has none.
+func (c *Config) AppParser(app string) Parser {
+	if p, ok := c.Parsers[app]; ok {
+		return p
+	}
+	return c.Parser
+}
+
+// SourceList returns the sources with the empty settings filled from the top-level ssh and source.
+func (c *Config) SourceList() []Source {
+	sources := c.Sources
+	if len(sources) == 0 {
+		sources = []Source{{}}
+	}
+	list := make([]Source, 0, len(sources))
+	for _, s := range sources {
+		s.SSH = s.SSH.inherit(c.SSH)
+		if s.Type == "" {
+			s.Type = c.Source.Type
+		}
+		if s.S3 == (S3{}) {
+			s.S3 = c.Source.S3
+		}
+		if s.Path == "" && s.Type == "s3" && c.Source.Type != "s3" {
+			s.Path = "{root}/{server}/{date}/{app}.log.xz"
+		}
+		// the root of a different source type is a different directory
+		if s.Root == "" && s.Type == c.Source.Type {
+			s.Root = c.Source.Root
+		}
+		if s.Path == "" {
+			s.Path = c.Source.Path
+		}
+		if len(s.Servers) == 0 {
+			s.Servers = c.Source.Servers
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// inherit fills the empty settings from parent, the auth settings are taken together.
+func (s SSH) inherit(parent SSH) SSH {
+	if s.User == "" {
+		s.User = parent.User
+	}
+	if s.Host == "" {
+		s.Host = parent.Host
+	}
+	if s.Port == 0 {
+		s.Port = parent.Port
+	}
+	if s.Config == "" {
+		s.Config = parent.Config
+	}
+	if s.KnownHosts == "" {
+		s.KnownHosts = parent.KnownHosts
+		s.TrustOnFirstUse = parent.TrustOnFirstUse
+		s.InsecureIgnoreHostKey = parent.InsecureIgnoreHostKey
+	}
+	if !s.Agent && len(s.KeyFiles) == 0 && s.Password == "" {
+		s.Agent = parent.Agent
+		s.KeyFiles = parent.KeyFiles
+		s.Passphrase = parent.Passphrase
+		s.Password = parent.Password
+	}
+	if len(s.Jump) == 0 {
+		s.Jump = parent.Jump
+	}
+	return s
+}
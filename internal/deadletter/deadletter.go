@@ -0,0 +1,102 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// Record is a line which could not be shipped, one JSON object per line in the dead-letter file.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source,omitempty"`
+	App    string    `json:"app"`
+	File   string    `json:"file"`
+	Line   int       `json:"line,omitempty"`
+	Raw    string    `json:"raw"`
+	Reason string    `json:"reason"`
+}
+
+// Writer appends the records to the dead-letter file, it can be used from several goroutines.
+type Writer struct {
+	lock sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+	n    int
+}
+
+// Open opens the dead-letter file for appending.
+func Open(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		f:   f,
+		enc: json.NewEncoder(f),
+	}, nil
+}
+
+func (w *Writer) Write(r Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.n++
+	return w.enc.Encode(r)
+}
+
+// Reject writes the line rejected by the storage, it is a storage.RejectFunc.
+func (w *Writer) Reject(line storage.LogLine, reason error) {
+	w.Write(Record{
+		Source: line.Origin.Source,
+		App:    line.App,
+		File:   line.Origin.File,
+		Line:   line.Origin.Line,
+		Raw:    line.Origin.Raw,
+		Reason: reason.Error(),
+	})
+}
+
+// Written returns the number of records written.
+func (w *Writer) Written() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.n
+}
+
+func (w *Writer) Close() error {
+	return w.f.Close()
+}
+
+// Read calls fn with every record of the dead-letter file.
+func Read(path string, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 20*1024*1024)
+	n := 0
+	for scanner.Scan() {
+		n++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("invalid record at line %d of %s: %w", n, path, err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
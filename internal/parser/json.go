@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+func init() {
+	Register("json", newJSON)
+}
+
+// jsonLines parses one JSON object per line, nested objects are flattened with "." separated keys.
+type jsonLines struct {
+	syslog bool
+	rules  rules
+}
+
+func newJSON(conf config.Parser) (Parser, error) {
+	r, err := newRules(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLines{syslog: conf.Syslog, rules: r}, nil
+}
+
+func (p *jsonLines) Parse(raw string) (storage.LogLine, error) {
+	var err error
+	ll := newLogLine(raw)
+	msg := raw
+	if p.syslog {
+		if msg, err = splitSyslog(raw, &ll); err != nil {
+			return ll, err
+		}
+	}
+	msg = p.rules.rewrite(msg)
+	ll.Fields["raw"] = msg
+
+	var values map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(msg))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return ll, fmt.Errorf("invalid json log line: %w", err)
+	}
+	p.apply(&ll, "", values)
+	return ll, nil
+}
+
+// apply stores the values, the drop and tag rules of a nested object are applied on its key before it is flattened.
+func (p *jsonLines) apply(ll *storage.LogLine, prefix string, values map[string]interface{}) {
+	for key, val := range values {
+		key = prefix + key
+		if val == nil {
+			continue
+		}
+		if tag, ok := p.rules.tags[key]; ok {
+			ll.Tags[tag] = jsonString(val)
+			continue
+		}
+		if p.rules.drop[key] {
+			continue
+		}
+		switch v := val.(type) {
+		case map[string]interface{}:
+			p.apply(ll, key+".", v)
+		case string:
+			p.rules.apply(ll, key, v)
+		case json.Number:
+			p.rules.apply(ll, key, v.String())
+		case []interface{}:
+			ll.Fields[key] = jsonString(v)
+		default:
+			ll.Fields[key] = v
+		}
+	}
+}
+
+// jsonString returns the strings and the numbers as they are, the other values as JSON.
+func jsonString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case json.Number:
+		return s.String()
+	case bool:
+		return fmt.Sprint(s)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+)
+
+func TestJSON(t *testing.T) {
+	p, err := New(config.Parser{
+		Type:       "json",
+		TimeKey:    "time",
+		TimeLayout: time.RFC3339,
+		Drop:       []string{"request", "response.body", "secret"},
+		Strings:    []string{"user.id"},
+		Tags:       map[string]string{"user": "user", "response.status": "status", "labels": "labels"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := `{"time":"2020-01-02T03:04:05Z","msg":"done","took":1.5,"count":3,"ok":true,"none":null,` +
+		`"request":{"body":"dropped","header":{"x":"y"}},` +
+		`"response":{"status":200,"body":"dropped","size":10},` +
+		`"user":{"id":"007","name":"bond"},` +
+		`"labels":["a","b"],"ids":[1,2],"secret":5}`
+	ll, err := p.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !ll.Time.Equal(want) {
+		t.Errorf("time %s, want %s", ll.Time, want)
+	}
+	wantTags := map[string]string{
+		// the nested object is the tag, it is not flattened
+		"user":   `{"id":"007","name":"bond"}`,
+		"status": "200",
+		"labels": `["a","b"]`,
+	}
+	if !reflect.DeepEqual(ll.Tags, wantTags) {
+		t.Errorf("tags %v, want %v", ll.Tags, wantTags)
+	}
+	wantFields := map[string]interface{}{
+		"raw":           raw,
+		"msg":           "done",
+		"took":          1.5,
+		"count":         int64(3),
+		"ok":            true,
+		"response.size": int64(10),
+		"ids":           "[1,2]",
+	}
+	if !reflect.DeepEqual(ll.Fields, wantFields) {
+		t.Errorf("fields %v, want %v", ll.Fields, wantFields)
+	}
+}
+
+func TestJSONNested(t *testing.T) {
+	p, err := New(config.Parser{
+		Type:    "json",
+		Strings: []string{"user.id"},
+		Tags:    map[string]string{"user.name": "user"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err := p.Parse(`{"user":{"id":"007","name":"bond","address":{"city":"London"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"user": "bond"}; !reflect.DeepEqual(ll.Tags, want) {
+		t.Errorf("tags %v, want %v", ll.Tags, want)
+	}
+	if ll.Fields["user.id"] != "007" || ll.Fields["user.address.city"] != "London" {
+		t.Errorf("fields %v, want the flattened keys", ll.Fields)
+	}
+}
+
+func TestJSONSyslog(t *testing.T) {
+	p, err := New(config.Parser{Type: "json", Syslog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ll, err := p.Parse(`2020-01-02T03:04:05.123+01:00 web1 app[123]: {"msg":"done"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ll.App != "app" || ll.Tags["host"] != "web1" || ll.Fields["msg"] != "done" || ll.Fields["raw"] != `{"msg":"done"}` {
+		t.Errorf("line %+v, want the syslog prefix parsed", ll)
+	}
+	if _, err := p.Parse(`2020-01-02T03:04:05.123+01:00 web1 app[123]: not json`); err == nil {
+		t.Error("no error of an invalid line")
+	}
+}
@@ -0,0 +1,28 @@
+package parser
+
+import (
+	"github.com/Ak-Army/logcollector/internal/config"
+)
+
+const nginxCombined = `^(?P<remote_addr>\S+) \S+ (?P<remote_user>\S+) \[(?P<time_local>[^\]]+)\] ` +
+	`"(?P<request>[^"]*)" (?P<status>\d{3}) (?P<body_bytes_sent>\S+) ` +
+	`"(?P<http_referer>[^"]*)" "(?P<http_user_agent>[^"]*)"`
+
+func init() {
+	Register("nginx", newNginx)
+}
+
+// newNginx is a regexp parser of the nginx combined log format.
+func newNginx(conf config.Parser) (Parser, error) {
+	if conf.Pattern == "" {
+		conf.Pattern = nginxCombined
+	}
+	if conf.TimeKey == "" || conf.TimeKey == "time" {
+		conf.TimeKey = "time_local"
+		conf.TimeLayout = "02/Jan/2006:15:04:05 -0700"
+	}
+	if conf.Tags == nil {
+		conf.Tags = map[string]string{"status": "status"}
+	}
+	return newRegexp(conf)
+}
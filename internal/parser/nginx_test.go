@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+)
+
+func TestNginx(t *testing.T) {
+	access := `192.168.1.2 - bond [02/Jan/2020:03:04:05 +0100] "GET /index.html HTTP/1.1" 200 512 "-" "curl/7.68.0"`
+	for _, tt := range []struct {
+		conf   config.Parser
+		raw    string
+		app    string
+		tags   map[string]string
+		fields map[string]interface{}
+		err    bool
+	}{
+		{
+			// the default parser config keeps the nginx time key
+			conf: config.Parser{TimeKey: "time", TimeLayout: "2006-01-02"},
+			raw:  access,
+			tags: map[string]string{"status": "200"},
+			fields: map[string]interface{}{
+				"raw": access, "remote_addr": "192.168.1.2", "remote_user": "bond", "request": "GET /index.html HTTP/1.1",
+				"body_bytes_sent": int64(512), "http_referer": "-", "http_user_agent": "curl/7.68.0",
+			},
+		},
+		{
+			conf: config.Parser{Syslog: true, Tags: map[string]string{"remote_addr": "client"}, Drop: []string{"http_user_agent"}},
+			raw:  "2020-01-02T03:04:06.1+01:00 web1 nginx_access: " + access,
+			app:  "nginx_access",
+			tags: map[string]string{"host": "web1", "client": "192.168.1.2"},
+			fields: map[string]interface{}{
+				"raw": access, "remote_user": "bond", "request": "GET /index.html HTTP/1.1", "status": int64(200),
+				"body_bytes_sent": int64(512), "http_referer": "-",
+			},
+		},
+		{raw: `192.168.1.2 - - [02/Jan/2020:03:04:05 +0100] "GET / HTTP/1.1" 200`, err: true},
+	} {
+		tt.conf.Type = "nginx"
+		p, err := New(tt.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ll, err := p.Parse(tt.raw)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.raw, err)
+			continue
+		}
+		if ll.App != tt.app || !reflect.DeepEqual(ll.Tags, tt.tags) || !reflect.DeepEqual(ll.Fields, tt.fields) {
+			t.Errorf("%s:\napp %q, tags %v, fields %v\nwant %q, %v, %v", tt.raw, ll.App, ll.Tags, ll.Fields, tt.app, tt.tags, tt.fields)
+		}
+		// the time of the access log is used over the syslog time
+		if want := time.Date(2020, 1, 2, 2, 4, 5, 0, time.UTC); !ll.Time.Equal(want) {
+			t.Errorf("%s: time %s, want %s", tt.raw, ll.Time, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// Parser turns a raw log line into a storage.LogLine.
+// LogLine.App is left empty when the line itself does not contain it.
+type Parser interface {
+	Parse(raw string) (storage.LogLine, error)
+}
+
+type Factory func(conf config.Parser) (Parser, error)
+
+var parsers = map[string]Factory{}
+
+// Register makes a parser available by name in the config.
+func Register(name string, factory Factory) {
+	parsers[name] = factory
+}
+
+// New creates the parser set by conf.Type.
+func New(conf config.Parser) (Parser, error) {
+	name := conf.Type
+	if name == "" {
+		name = "syslog"
+	}
+	factory, ok := parsers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown parser: %s, available: %s", name, strings.Join(Names(), ", "))
+	}
+	return factory(conf)
+}
+
+// Names returns the registered parser names.
+func Names() []string {
+	var names []string
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newLogLine(raw string) storage.LogLine {
+	return storage.LogLine{
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+		Time:   time.Now(),
+		Size:   len(raw),
+	}
+}
+
+// splitSyslog parses the "<time> <host> <app>[pid]: message" prefix written by rsyslog.
+func splitSyslog(raw string, ll *storage.LogLine) (string, error) {
+	logs := strings.SplitN(raw, " ", 4)
+	if len(logs) < 4 {
+		return "", fmt.Errorf("too short log line: %s", raw)
+	}
+	ll.App = strings.TrimSuffix(strings.Split(logs[2], "[")[0], ":")
+	v := strings.Split(logs[0], "+")
+	ll.Time, _ = time.Parse("2006-01-02T15:04:05.99999", v[0])
+	ll.Tags["host"] = logs[1]
+	return logs[3], nil
+}
+
+type rules struct {
+	replace    []replace
+	drop       map[string]bool
+	strings    map[string]bool
+	expand     map[string]bool
+	tags       map[string]string
+	timeKey    string
+	timeLayout string
+}
+
+type replace struct {
+	pattern *regexp.Regexp
+	with    string
+}
+
+func newRules(conf config.Parser) (rules, error) {
+	var replaces []replace
+	for _, r := range conf.Replace {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return rules{}, fmt.Errorf("invalid replace pattern: %w", err)
+		}
+		replaces = append(replaces, replace{pattern: pattern, with: r.With})
+	}
+	return rules{
+		replace:    replaces,
+		drop:       set(conf.Drop),
+		strings:    set(conf.Strings),
+		expand:     set(conf.Expand),
+		tags:       conf.Tags,
+		timeKey:    conf.TimeKey,
+		timeLayout: conf.TimeLayout,
+	}, nil
+}
+
+// rewrite applies the replace rules on the message.
+func (r rules) rewrite(msg string) string {
+	for _, rep := range r.replace {
+		msg = rep.pattern.ReplaceAllString(msg, rep.with)
+	}
+	return msg
+}
+
+// apply stores the key value pair as a tag, the time or a field of the log line.
+func (r rules) apply(ll *storage.LogLine, key string, val string) {
+	if tag, ok := r.tags[key]; ok {
+		ll.Tags[tag] = val
+		return
+	}
+	switch {
+	case r.drop[key]:
+	case key == r.timeKey && r.timeKey != "":
+		v := strings.Split(val, " m=")
+		if t, err := time.Parse(r.timeLayout, v[0]); err == nil {
+			ll.Time = t
+		}
+	case r.expand[key]:
+		expand(ll, val)
+		ll.Fields[key] = val
+	case r.strings[key]:
+		ll.Fields[key] = val
+	default:
+		ll.Fields[key] = convert(val)
+	}
+}
+
+// expand stores the numeric values of a "QueueStat{running=0, completed=0, avWorker=1}" value.
+func expand(ll *storage.LogLine, val string) {
+	start := strings.Index(val, "{")
+	end := strings.LastIndex(val, "}")
+	if start == -1 || end < start {
+		return
+	}
+	for _, kv := range strings.Split(val[start+1:end], ", ") {
+		stat := strings.SplitN(kv, "=", 2)
+		if len(stat) != 2 {
+			continue
+		}
+		if i, err := strconv.ParseInt(stat[1], 10, 64); err == nil {
+			ll.Fields[stat[0]] = i
+		}
+	}
+}
+
+// convert returns the value as int64, float64, milliseconds of a duration or the string itself.
+func convert(val string) interface{} {
+	if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return i
+	} else if f, err := strconv.ParseFloat(val, 64); err == nil {
+		return f
+	} else if d, err := time.ParseDuration(val); err == nil {
+		return d.Milliseconds()
+	}
+	return val
+}
+
+func set(list []string) map[string]bool {
+	m := make(map[string]bool, len(list))
+	for _, v := range list {
+		m[v] = true
+	}
+	return m
+}
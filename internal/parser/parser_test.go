@@ -0,0 +1,180 @@
+package parser
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logfmt/logfmt"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+func TestNew(t *testing.T) {
+	for _, tt := range []struct {
+		conf config.Parser
+		err  string
+	}{
+		{conf: config.Parser{}},
+		{conf: config.Parser{Type: "nginx"}},
+		{conf: config.Parser{Type: "csv"}, err: "unknown parser: csv, available: json, nginx, regexp, syslog"},
+		{conf: config.Parser{Type: "regexp"}, err: "regexp parser without pattern"},
+		{conf: config.Parser{Type: "regexp", Pattern: "("}, err: "invalid regexp parser pattern"},
+		{conf: config.Parser{Replace: []config.Replace{{Pattern: "("}}}, err: "invalid replace pattern"},
+	} {
+		_, err := New(tt.conf)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("%+v: error %v, want %q", tt.conf, err, tt.err)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	r, err := newRules(config.Parser{
+		Replace:    []config.Replace{{Pattern: `secret=\S+ `, With: ""}},
+		Drop:       []string{"password"},
+		Strings:    []string{"phone"},
+		Expand:     []string{"stat"},
+		Tags:       map[string]string{"method": "method_topic", "phone": "phone"},
+		TimeKey:    "time",
+		TimeLayout: "2006-01-02 15:04:05 -0700",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := r.rewrite("a=1 secret=x b=2"); msg != "a=1 b=2" {
+		t.Errorf("rewritten %q", msg)
+	}
+	for _, tt := range []struct {
+		key, val string
+		tags     map[string]string
+		fields   map[string]interface{}
+		time     time.Time
+	}{
+		{key: "count", val: "3", fields: map[string]interface{}{"count": int64(3)}},
+		{key: "took", val: "1.5", fields: map[string]interface{}{"took": 1.5}},
+		{key: "serveTime", val: "1.5s", fields: map[string]interface{}{"serveTime": int64(1500)}},
+		{key: "msg", val: "done", fields: map[string]interface{}{"msg": "done"}},
+		{key: "customer", val: "0042", fields: map[string]interface{}{"customer": int64(42)}},
+		{key: "password", val: "x"},
+		// the tags are checked before the other rules
+		{key: "phone", val: "0036", tags: map[string]string{"phone": "0036"}},
+		{key: "method", val: "POST", tags: map[string]string{"method_topic": "POST"}},
+		{
+			key: "stat", val: "QueueStat{running=1, lastJobTime=1970-01-01 01:00:00 +0100 CET, busyWorker=0}",
+			fields: map[string]interface{}{
+				"stat":       "QueueStat{running=1, lastJobTime=1970-01-01 01:00:00 +0100 CET, busyWorker=0}",
+				"running":    int64(1),
+				"busyWorker": int64(0),
+			},
+		},
+		{key: "stat", val: "none", fields: map[string]interface{}{"stat": "none"}},
+		{key: "time", val: "2020-01-02 03:04:05 +0100 m=+0.001", time: time.Date(2020, 1, 2, 2, 4, 5, 0, time.UTC)},
+		{key: "time", val: "yesterday"},
+	} {
+		ll := storage.LogLine{Tags: make(map[string]string), Fields: make(map[string]interface{})}
+		r.apply(&ll, tt.key, tt.val)
+		if tt.tags == nil {
+			tt.tags = map[string]string{}
+		}
+		if tt.fields == nil {
+			tt.fields = map[string]interface{}{}
+		}
+		if !reflect.DeepEqual(ll.Tags, tt.tags) || !reflect.DeepEqual(ll.Fields, tt.fields) || !ll.Time.Equal(tt.time) {
+			t.Errorf("%s=%s: tags %v, fields %v, time %s, want %v, %v, %s", tt.key, tt.val, ll.Tags, ll.Fields, ll.Time, tt.tags, tt.fields, tt.time)
+		}
+	}
+}
+
+// processLine is the parsing of the collect command before the parsers, the lines were rewritten
+// by the sed of the download command.
+func processLine(raw string) storage.LogLine {
+	raw = regexp.MustCompile(`(.*) requestBody=".*" (serveTime.*)`).ReplaceAllString(raw, "$1 $2")
+	logs := strings.SplitN(raw, " ", 4)
+	ll := storage.LogLine{
+		App:    strings.Split(logs[2], "[")[0],
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+		Time:   time.Now(),
+		Size:   len(raw),
+	}
+	v := strings.Split(logs[0], "+")
+	ll.Time, _ = time.Parse("2006-01-02T15:04:05.99999", v[0])
+	ll.Tags["host"] = logs[1]
+	ll.Fields["raw"] = logs[3]
+
+	dec := logfmt.NewDecoder(strings.NewReader(logs[3]))
+	for dec.ScanRecord() {
+		for dec.ScanKeyval() {
+			val := string(dec.Value())
+			key := string(dec.Key())
+			switch key {
+			case "requestBody":
+				continue
+			case "customer":
+				ll.Fields[key] = val
+			case "method", "topic":
+				ll.Tags["method_topic"] = val
+			case "time":
+				v := strings.Split(val, " m=")
+				ll.Time, _ = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", v[0])
+			case "phone", "op", "secondaryProj", "queueId", "userName", "mode":
+				ll.Fields[key] = val
+			case "stat":
+				if ll.App == "go-queue" {
+					kvs := strings.Split(val[10:len(val)-2], ", ")
+					for _, kv := range kvs {
+						queueStat := strings.Split(kv, "=")
+						if i, err := strconv.ParseInt(queueStat[1], 10, 64); err == nil {
+							ll.Fields[queueStat[0]] = i
+						}
+					}
+				}
+				ll.Fields[key] = val
+			default:
+				if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+					ll.Fields[key] = i
+				} else if i, err := strconv.ParseFloat(val, 64); err == nil {
+					ll.Fields[key] = i
+				} else if i, err := time.ParseDuration(val); err == nil {
+					ll.Fields[key] = i.Milliseconds()
+				} else {
+					ll.Fields[key] = val
+				}
+			}
+		}
+	}
+	return ll
+}
+
+// The default parser config stores the lines like the collect command did before the parsers.
+func TestDefaultRules(t *testing.T) {
+	p, err := New(config.Default().Parser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := `2020-01-02T03:04:05.12345+01:00 web1 go-queue[123]: time="2020-01-02 03:04:05.123456789 +0100 CET m=+0.001" ` +
+		`level=info msg="job done" method=POST topic=sms customer=0042 phone=0036301234567 op=send mode=async ` +
+		`requestBody="{\"to\":\"0036301234567\"}" serveTime=12ms took=1.5 count=3 ` +
+		`stat="QueueStat{running=1, completed=2, pending=0, total=3, lastJobTime=1970-01-01 01:00:00 +0100 CET, avWorker=1, busyWorker=0}"`
+	ll, err := p.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := processLine(raw)
+	// the last value of the stat was cut off before
+	want.Fields["busyWorker"] = int64(0)
+	if ll.App != want.App || !ll.Time.Equal(want.Time) {
+		t.Errorf("app %s, time %s, want %s, %s", ll.App, ll.Time, want.App, want.Time)
+	}
+	if !reflect.DeepEqual(ll.Tags, want.Tags) {
+		t.Errorf("tags %v, want %v", ll.Tags, want.Tags)
+	}
+	if !reflect.DeepEqual(ll.Fields, want.Fields) {
+		t.Errorf("fields\n%v\nwant\n%v", ll.Fields, want.Fields)
+	}
+}
@@ -0,0 +1,65 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+func init() {
+	Register("regexp", newRegexp)
+}
+
+// regexpParser stores the named groups of the pattern.
+type regexpParser struct {
+	syslog  bool
+	pattern *regexp.Regexp
+	rules   rules
+}
+
+func newRegexp(conf config.Parser) (Parser, error) {
+	if conf.Pattern == "" {
+		return nil, errors.New("regexp parser without pattern")
+	}
+	pattern, err := regexp.Compile(conf.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp parser pattern: %w", err)
+	}
+	r, err := newRules(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &regexpParser{
+		syslog:  conf.Syslog,
+		pattern: pattern,
+		rules:   r,
+	}, nil
+}
+
+func (p *regexpParser) Parse(raw string) (storage.LogLine, error) {
+	var err error
+	ll := newLogLine(raw)
+	msg := raw
+	if p.syslog {
+		if msg, err = splitSyslog(raw, &ll); err != nil {
+			return ll, err
+		}
+	}
+	msg = p.rules.rewrite(msg)
+	ll.Fields["raw"] = msg
+
+	match := p.pattern.FindStringSubmatch(msg)
+	if match == nil {
+		return ll, fmt.Errorf("log line does not match pattern: %s", raw)
+	}
+	for i, name := range p.pattern.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		p.rules.apply(&ll, name, match[i])
+	}
+	return ll, nil
+}
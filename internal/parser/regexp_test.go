@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+)
+
+func TestRegexp(t *testing.T) {
+	for _, tt := range []struct {
+		conf   config.Parser
+		raw    string
+		app    string
+		tags   map[string]string
+		fields map[string]interface{}
+		time   time.Time
+		err    bool
+	}{
+		{
+			conf: config.Parser{
+				Pattern:    `^(?P<time>\S+) (?P<level>[A-Z]+) (?P<msg>.*?)( took=(?P<took>\S+))?$`,
+				TimeKey:    "time",
+				TimeLayout: time.RFC3339,
+				Tags:       map[string]string{"level": "level"},
+			},
+			raw:    "2020-01-02T03:04:05Z INFO job done took=15ms",
+			tags:   map[string]string{"level": "INFO"},
+			fields: map[string]interface{}{"raw": "2020-01-02T03:04:05Z INFO job done took=15ms", "msg": "job done", "took": int64(15)},
+			time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		{
+			// the unnamed groups are not stored, the optional group is an empty field
+			conf:   config.Parser{Pattern: `^(\w+) (?P<user>\w+)( (?P<id>\d+))?$`, Strings: []string{"id"}},
+			raw:    "login bond",
+			tags:   map[string]string{},
+			fields: map[string]interface{}{"raw": "login bond", "user": "bond", "id": ""},
+		},
+		{
+			conf: config.Parser{
+				Pattern: `^(?P<op>\w+) (?P<phone>\d+)$`,
+				Syslog:  true,
+				Replace: []config.Replace{{Pattern: `^send `, With: "sms "}},
+				Strings: []string{"phone"},
+			},
+			raw:    "2020-01-02T03:04:05.5+01:00 web1 sms[1]: send 0036301234567",
+			app:    "sms",
+			tags:   map[string]string{"host": "web1"},
+			fields: map[string]interface{}{"raw": "sms 0036301234567", "op": "sms", "phone": "0036301234567"},
+			time:   time.Date(2020, 1, 2, 3, 4, 5, 500000000, time.UTC),
+		},
+		{conf: config.Parser{Pattern: `^(?P<n>\d+)$`}, raw: "abc", err: true},
+		{conf: config.Parser{Pattern: `^(?P<n>\d+)$`, Syslog: true}, raw: "123", err: true},
+	} {
+		tt.conf.Type = "regexp"
+		p, err := New(tt.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ll, err := p.Parse(tt.raw)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.raw, err)
+			continue
+		}
+		if ll.App != tt.app || !reflect.DeepEqual(ll.Tags, tt.tags) || !reflect.DeepEqual(ll.Fields, tt.fields) {
+			t.Errorf("%s: app %q, tags %v, fields %v, want %q, %v, %v", tt.raw, ll.App, ll.Tags, ll.Fields, tt.app, tt.tags, tt.fields)
+		}
+		if !tt.time.IsZero() && !ll.Time.Equal(tt.time) {
+			t.Errorf("%s: time %s, want %s", tt.raw, ll.Time, tt.time)
+		}
+	}
+}
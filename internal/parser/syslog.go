@@ -0,0 +1,45 @@
+package parser
+
+import (
+	"strings"
+
+	"github.com/go-logfmt/logfmt"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+func init() {
+	Register("syslog", newSyslog)
+}
+
+// syslog parses the logfmt message after the syslog prefix.
+type syslog struct {
+	rules rules
+}
+
+func newSyslog(conf config.Parser) (Parser, error) {
+	r, err := newRules(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &syslog{rules: r}, nil
+}
+
+func (p *syslog) Parse(raw string) (storage.LogLine, error) {
+	ll := newLogLine(raw)
+	msg, err := splitSyslog(raw, &ll)
+	if err != nil {
+		return ll, err
+	}
+	msg = p.rules.rewrite(msg)
+	ll.Fields["raw"] = msg
+
+	dec := logfmt.NewDecoder(strings.NewReader(msg))
+	for dec.ScanRecord() {
+		for dec.ScanKeyval() {
+			p.rules.apply(&ll, string(dec.Key()), string(dec.Value()))
+		}
+	}
+	return ll, nil
+}
@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/config"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+func TestSyslog(t *testing.T) {
+	p, err := New(config.Parser{
+		Type:    "syslog",
+		Replace: []config.Replace{{Pattern: `password=\S+ `, With: ""}},
+		Drop:    []string{"secret"},
+		Strings: []string{"customer"},
+		Tags:    map[string]string{"level": "level"},
+		Expand:  []string{"stat"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2020, 1, 2, 3, 4, 5, 123000000, time.UTC)
+	for _, tt := range []struct {
+		raw  string
+		want storage.LogLine
+		err  bool
+	}{
+		{
+			raw: `2020-01-02T03:04:05.123+01:00 web1 app[123]: level=info msg="job done" customer=0042 took=1.5 count=3`,
+			want: storage.LogLine{
+				App:  "app",
+				Tags: map[string]string{"host": "web1", "level": "info"},
+				Fields: map[string]interface{}{
+					"raw": `level=info msg="job done" customer=0042 took=1.5 count=3`,
+					"msg": "job done", "customer": "0042", "took": 1.5, "count": int64(3),
+				},
+				Time: day,
+			},
+		},
+		{
+			// the app without pid and the dropped, rewritten and expanded keys
+			raw: `2020-01-02T03:04:05.123+01:00 web1 cron: password=x secret=y serveTime=2s stat="Stat{done=4}"`,
+			want: storage.LogLine{
+				App:  "cron",
+				Tags: map[string]string{"host": "web1"},
+				Fields: map[string]interface{}{
+					"raw":       `secret=y serveTime=2s stat="Stat{done=4}"`,
+					"serveTime": int64(2000), "stat": "Stat{done=4}", "done": int64(4),
+				},
+				Time: day,
+			},
+		},
+		{raw: "web1 app[123]: short", err: true},
+	} {
+		ll, err := p.Parse(tt.raw)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.raw, err)
+			continue
+		}
+		tt.want.Size = len(tt.raw)
+		if !reflect.DeepEqual(ll, tt.want) {
+			t.Errorf("%s:\nline %+v\nwant %+v", tt.raw, ll, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package source
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Local reads the log files from the local disk.
+type Local struct{}
+
+func (Local) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (Local) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (Local) Open(path string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (l Local) Download(localFile, file string) error {
+	return download(l, localFile, file)
+}
+
+func (Local) Close() error {
+	return nil
+}
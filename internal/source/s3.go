@@ -0,0 +1,332 @@
+package source
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 reads the log files from a bucket of an S3 compatible object storage, the paths are the object keys
+// with a leading slash.
+// The requests are signed with AWS signature version 4 and use path-style urls, so MinIO works too.
+type S3 struct {
+	// Endpoint is the url of the storage, like https://s3.eu-west-1.amazonaws.com or http://localhost:9000.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (o objectInfo) Name() string       { return path.Base(o.name) }
+func (o objectInfo) Size() int64        { return o.size }
+func (o objectInfo) Mode() os.FileMode  { return 0444 }
+func (o objectInfo) ModTime() time.Time { return o.modTime }
+func (o objectInfo) IsDir() bool        { return false }
+func (o objectInfo) Sys() interface{}   { return nil }
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// Glob returns the keys matching the pattern. The pattern is walked level by level:
+// the levels without a wildcard are added to the prefix, the others are listed with the / delimiter,
+// so only the objects of the matching prefixes are listed.
+func (s *S3) Glob(pattern string) ([]string, error) {
+	levels := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	prefixes := []string{""}
+	for i, level := range levels {
+		last := i == len(levels)-1
+		if !last && !strings.ContainsAny(level, `*?[\`) {
+			for j := range prefixes {
+				prefixes[j] += level + "/"
+			}
+			continue
+		}
+		var next []string
+		for _, prefix := range prefixes {
+			dirs, keys, err := s.list(prefix + literalPrefix(level))
+			if err != nil {
+				return nil, err
+			}
+			names := dirs
+			if last {
+				names = keys
+			}
+			for _, name := range names {
+				ok, err := path.Match(level, strings.TrimSuffix(strings.TrimPrefix(name, prefix), "/"))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					next = append(next, name)
+				}
+			}
+		}
+		prefixes = next
+	}
+	keys := make([]string, 0, len(prefixes))
+	for _, key := range prefixes {
+		keys = append(keys, "/"+key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// literalPrefix returns the beginning of the level before its first wildcard.
+func literalPrefix(level string) string {
+	if i := strings.IndexAny(level, `*?[\`); i != -1 {
+		return level[:i]
+	}
+	return level
+}
+
+// list returns the prefixes ending with the next / and the keys of the objects under the prefix, without the deeper ones.
+func (s *S3) list(prefix string) ([]string, []string, error) {
+	var dirs, keys []string
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode object list: %w", err)
+		}
+		for _, p := range result.CommonPrefixes {
+			dirs = append(dirs, p.Prefix)
+		}
+		for _, o := range result.Contents {
+			keys = append(keys, o.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return dirs, keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(key string) (os.FileInfo, error) {
+	key = strings.TrimPrefix(key, "/")
+	resp, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	info := objectInfo{name: key, size: resp.ContentLength}
+	if info.modTime, err = http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+		return nil, fmt.Errorf("invalid Last-Modified of %s: %w", key, err)
+	}
+	return info, nil
+}
+
+// Open reads the object from the given offset with a range request.
+func (s *S3) Open(key string, offset int64) (io.ReadCloser, error) {
+	key = strings.TrimPrefix(key, "/")
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := s.do(http.MethodGet, key, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	// a storage ignoring the range sends the whole object
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 GET %s from %d: %s, want 206 Partial Content", key, offset, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Download(localFile, key string) error {
+	return download(s, localFile, key)
+}
+
+func (s *S3) Close() error {
+	return nil
+}
+
+// request returns the unsigned request of the key, the path is sent escaped as the signature requires.
+func (s *S3) request(method string, key string, query url.Values, header http.Header) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// do sends the signed request, a response other than 2xx is returned as an error.
+func (s *S3) do(method string, key string, query url.Values, header http.Header) (*http.Response, error) {
+	req, err := s.request(method, key, query, header)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: method, Path: key, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("s3 %s %s: %s %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS signature version 4 authorization of the request without body.
+// The escaped path of the url is signed, so it must be escaped like uriEncode does.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if s.AccessKey == "" {
+		return
+	}
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": emptyPayloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		headers["range"] = r
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery encodes the query sorted by key, as the signature requires.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything except the unreserved characters, slash is kept unless encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,40 @@
+package source
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Source is where the log files are read from, the ssh client is a Source too.
+type Source interface {
+	Glob(pattern string) ([]string, error)
+	Stat(path string) (os.FileInfo, error)
+	// Open opens the file for reading from the given offset.
+	Open(path string, offset int64) (io.ReadCloser, error)
+	// Download copies the file as it is into localFile.
+	Download(localFile, remoteFile string) error
+	Close() error
+}
+
+// download copies the file of the source into localFile through localFile.part.
+func download(s Source, localFile, file string) error {
+	src, err := s.Open(file, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	part := localFile + ".part"
+	dst, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("unable to download %s: %w", file, err)
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, localFile)
+}
@@ -0,0 +1,38 @@
+package source
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+var placeholder = regexp.MustCompile(`\{(root|server|date|app)(?::([^}]+))?\}`)
+
+// Template is a path with {root}, {server}, {date}, {date:<go time layout>} and {app} placeholders,
+// e.g. {root}/{server}/{date:20060102}/{app}/*.log.xz. {date} is formatted as 20060102.
+type Template string
+
+func (t Template) Path(root, server string, date time.Time, app string) string {
+	return placeholder.ReplaceAllStringFunc(string(t), func(m string) string {
+		match := placeholder.FindStringSubmatch(m)
+		switch match[1] {
+		case "root":
+			return strings.TrimSuffix(root, "/")
+		case "server":
+			return server
+		case "app":
+			return app
+		}
+		layout := match[2]
+		if layout == "" {
+			layout = "20060102"
+		}
+		return date.Format(layout)
+	})
+}
+
+// ServerPrefix returns the beginning of the paths of the server, up to the server name.
+func (t Template) ServerPrefix(root, server string) string {
+	prefix := strings.SplitN(string(t), "{server}", 2)[0]
+	return Template(prefix).Path(root, "", time.Time{}, "") + server
+}
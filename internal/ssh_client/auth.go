@@ -0,0 +1,195 @@
+package ssh_client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kevinburke/ssh_config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type Auth struct {
+	User       string
+	Agent      bool
+	KeyFiles   []string
+	Passphrase string
+	Password   string
+	// KnownHosts is the known_hosts file used to verify the host key.
+	KnownHosts string
+	// TrustOnFirstUse adds the key of an unknown host to the KnownHosts file.
+	TrustOnFirstUse       bool
+	InsecureIgnoreHostKey bool
+}
+
+// HostConfig is a Host entry of an ssh config file.
+type HostConfig struct {
+	HostName     string
+	User         string
+	Port         int
+	IdentityFile string
+	ProxyJump    string
+}
+
+// ClientConfig returns the ssh client config with the configured auth methods and host key verification.
+func (a Auth) ClientConfig() (*ssh.ClientConfig, error) {
+	var methods []ssh.AuthMethod
+	var signers []ssh.Signer
+	for _, file := range a.KeyFiles {
+		signer, err := a.signer(file)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if a.Agent {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				return nil, fmt.Errorf("unable to connect to ssh agent: %w", err)
+			}
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			log.Println("SSH_AUTH_SOCK is not set, ssh agent is not used")
+		}
+	}
+	if a.Password != "" {
+		methods = append(methods, ssh.Password(a.Password))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no ssh auth method: set key files, agent or password")
+	}
+	hostKeyCallback, err := a.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            a.User,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func (a Auth) signer(file string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(ExpandHome(file))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+	if a.Passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(a.Passphrase))
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("key file %s needs passphrase", file)
+	}
+	return signer, err
+}
+
+var knownHostsLock sync.Mutex
+
+func (a Auth) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if a.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	if a.KnownHosts == "" {
+		return nil, errors.New("known hosts file is not set")
+	}
+	file := ExpandHome(a.KnownHosts)
+	if a.TrustOnFirstUse {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known hosts: %w", err)
+	}
+	if !a.TrustOnFirstUse {
+		return callback, nil
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok || len(keyErr.Want) > 0 {
+			return err
+		}
+		log.Printf("Add unknown host to %s: %s\n", file, hostname)
+		knownHostsLock.Lock()
+		defer knownHostsLock.Unlock()
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}, nil
+}
+
+// LookupHost returns the Host entry of the alias from the ssh config file, a missing file is an empty entry.
+func LookupHost(configFile, alias string) (HostConfig, error) {
+	var host HostConfig
+	f, err := os.Open(ExpandHome(configFile))
+	if os.IsNotExist(err) {
+		return host, nil
+	}
+	if err != nil {
+		return host, err
+	}
+	defer f.Close()
+	conf, err := ssh_config.Decode(f)
+	if err != nil {
+		return host, fmt.Errorf("unable to parse ssh config: %w", err)
+	}
+	if host.HostName, err = conf.Get(alias, "HostName"); err != nil {
+		return host, err
+	}
+	if host.User, err = conf.Get(alias, "User"); err != nil {
+		return host, err
+	}
+	if host.IdentityFile, err = conf.Get(alias, "IdentityFile"); err != nil {
+		return host, err
+	}
+	if host.ProxyJump, err = conf.Get(alias, "ProxyJump"); err != nil {
+		return host, err
+	}
+	port, err := conf.Get(alias, "Port")
+	if err != nil {
+		return host, err
+	}
+	if port != "" {
+		if host.Port, err = strconv.Atoi(port); err != nil {
+			return host, fmt.Errorf("invalid port of %s: %s", alias, port)
+		}
+	}
+	return host, nil
+}
+
+// ExpandHome replaces the leading ~ with the home directory.
+func ExpandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
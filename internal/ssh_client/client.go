@@ -3,8 +3,8 @@ package ssh_client
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,6 +12,9 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/Ak-Army/logcollector/internal/retry"
+
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -27,19 +30,28 @@ type SSHClient struct {
 	Config *ssh.ClientConfig
 	Host   string
 	Port   int
-	Ctx    context.Context
-	conn   *ssh.Client
+	// Jumps are the hosts the connection goes through in order, like ssh -J.
+	Jumps []Hop
+	// Retry is used to connect, it is stopped when Ctx is done.
+	Retry retry.Policy
+	Ctx   context.Context
+	// lock guards the connection of the client, the clients of other hosts are not waited for.
+	lock sync.Mutex
+	conn *ssh.Client
+	sftp *sftp.Client
+	hops []*ssh.Client
 }
 
-var lock sync.Mutex
+type Hop struct {
+	Config *ssh.ClientConfig
+	Host   string
+	Port   int
+}
 
+// RunCommand runs the command, the connection is closed when the exit code is missing so the next command connects again.
 func (client *SSHClient) RunCommand(cmd *SSHCommand) error {
-	var (
-		session *ssh.Session
-		err     error
-	)
-
-	if session, err = client.NewSession(); err != nil {
+	session, err := client.NewSession()
+	if err != nil {
 		return err
 	}
 	defer session.Close()
@@ -50,14 +62,18 @@ func (client *SSHClient) RunCommand(cmd *SSHCommand) error {
 	err = session.Run(cmd.Path)
 	if e, ok := err.(*ssh.ExitMissingError); ok {
 		log.Printf("Exit code missing: %s\n", e.Error())
-		lock.Lock()
-		client.conn = nil
-		lock.Unlock()
-		return client.RunCommand(cmd)
+		client.Close()
 	}
 	return err
 }
 
+func (client *SSHClient) context() context.Context {
+	if client.Ctx != nil {
+		return client.Ctx
+	}
+	return context.Background()
+}
+
 func (client *SSHClient) prepareCommand(session *ssh.Session, cmd *SSHCommand) error {
 	for _, env := range cmd.Env {
 		variable := strings.Split(env, "=")
@@ -98,12 +114,11 @@ func (client *SSHClient) prepareCommand(session *ssh.Session, cmd *SSHCommand) e
 }
 
 func (client *SSHClient) NewSession() (*ssh.Session, error) {
-	lock.Lock()
-	defer lock.Unlock()
-	if err := client.connect(); err != nil {
+	conn, err := client.connect()
+	if err != nil {
 		return nil, err
 	}
-	session, err := client.conn.NewSession()
+	session, err := conn.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %s", err)
 	}
@@ -122,60 +137,273 @@ func (client *SSHClient) NewSession() (*ssh.Session, error) {
 	return session, nil
 }
 
-func (client *SSHClient) connect() error {
-	if client.conn == nil {
+// connect returns the connection, it is dialed with the retry policy when there is none.
+// The error is permanent when the retries ran out, so the callers retrying their calls do not dial again.
+func (client *SSHClient) connect() (*ssh.Client, error) {
+	var conn *ssh.Client
+	err := client.Retry.Do(client.context(), func() error {
+		client.lock.Lock()
+		conn = client.conn
+		client.lock.Unlock()
+		if conn != nil {
+			return nil
+		}
 		log.Printf("Connect to: %s:%d\n", client.Host, client.Port)
-		var err error
-		client.conn, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", client.Host, client.Port), client.Config)
+		c, hops, err := client.dial(Hop{Config: client.Config, Host: client.Host, Port: client.Port})
 		if err != nil {
-			return fmt.Errorf("failed to dial: %s", err)
+			err = fmt.Errorf("failed to dial: %w", err)
+			if strings.Contains(err.Error(), "unable to authenticate") {
+				return retry.Permanent(err)
+			}
+			return err
+		}
+		client.lock.Lock()
+		defer client.lock.Unlock()
+		if client.conn != nil {
+			// connected by another call in the meantime
+			c.Close()
+			closeAll(hops)
+			conn = client.conn
+			return nil
 		}
+		client.conn, client.hops = c, hops
+		conn = c
+		return nil
+	}, func(attempt int, err error) {
+		log.Printf("Unable to connect, retry %d: %s\n", attempt, err)
+	})
+	if err != nil {
+		return nil, retry.Permanent(err)
 	}
-	return nil
+	return conn, nil
 }
 
-func (client *SSHClient) FileFromRemoteHost(localFile, targetFile string) error {
-	var (
-		session *ssh.Session
-		err     error
-	)
+// dial connects to the target through the jump hosts, the connections of the jump hosts are returned in order.
+func (client *SSHClient) dial(target Hop) (*ssh.Client, []*ssh.Client, error) {
+	var hops []*ssh.Client
+	var prev *ssh.Client
+	route := append(append([]Hop(nil), client.Jumps...), target)
+	for _, hop := range route {
+		addr := fmt.Sprintf("%s:%d", hop.Host, hop.Port)
+		if prev == nil {
+			conn, err := ssh.Dial("tcp", addr, hop.Config)
+			if err != nil {
+				return nil, nil, err
+			}
+			prev = conn
+			continue
+		}
+		log.Printf("Jump to: %s\n", addr)
+		hops = append(hops, prev)
+		netConn, err := prev.Dial("tcp", addr)
+		if err != nil {
+			closeAll(hops)
+			return nil, nil, fmt.Errorf("unable to reach %s: %w", addr, err)
+		}
+		conn, chans, reqs, err := ssh.NewClientConn(netConn, addr, hop.Config)
+		if err != nil {
+			netConn.Close()
+			closeAll(hops)
+			return nil, nil, err
+		}
+		prev = ssh.NewClient(conn, chans, reqs)
+	}
+	return prev, hops, nil
+}
+
+// closeAll closes the connections of the jump hosts from the last one.
+func closeAll(hops []*ssh.Client) {
+	for i := len(hops) - 1; i >= 0; i-- {
+		hops[i].Close()
+	}
+}
 
-	if session, err = client.NewSession(); err != nil {
+func (client *SSHClient) SFTP() (*sftp.Client, error) {
+	client.lock.Lock()
+	c := client.sftp
+	client.lock.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	conn, err := client.connect()
+	if err != nil {
+		return nil, err
+	}
+	if c, err = sftp.NewClient(conn); err != nil {
+		return nil, fmt.Errorf("failed to start sftp: %s", err)
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.conn != conn {
+		c.Close()
+		return nil, errors.New("connection closed")
+	}
+	if client.sftp != nil {
+		// started by another call in the meantime
+		c.Close()
+		return client.sftp, nil
+	}
+	client.sftp = c
+	return c, nil
+}
+
+// reset closes the connection when the sftp client failed on it, the next call connects again.
+// The errors of the server, like a missing file, keep the connection.
+func (client *SSHClient) reset(c *sftp.Client, err error) {
+	if !broken(err) {
+		return
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.sftp != c {
+		// connected again in the meantime
+		return
+	}
+	log.Printf("Reconnect to %s:%d after: %s\n", client.Host, client.Port, err)
+	client.close()
+}
+
+// broken reports whether the error came from the connection and not from the server or the local files.
+func broken(err error) bool {
+	if err == nil || err == io.EOF || os.IsNotExist(err) || errors.Is(err, sftp.ErrBadPattern) {
+		return false
+	}
+	var status *sftp.StatusError
+	var pathErr *os.PathError
+	return !errors.As(err, &status) && !errors.As(err, &pathErr)
+}
+
+func (client *SSHClient) ReadDir(path string) ([]os.FileInfo, error) {
+	c, err := client.SFTP()
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.ReadDir(path)
+	client.reset(c, err)
+	return files, err
+}
+
+func (client *SSHClient) Stat(path string) (os.FileInfo, error) {
+	c, err := client.SFTP()
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Stat(path)
+	client.reset(c, err)
+	return info, err
+}
+
+func (client *SSHClient) Glob(pattern string) ([]string, error) {
+	c, err := client.SFTP()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := c.Glob(pattern)
+	client.reset(c, err)
+	return matches, err
+}
+
+// Open opens the remote file for reading from the given offset.
+func (client *SSHClient) Open(path string, offset int64) (io.ReadCloser, error) {
+	c, err := client.SFTP()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.Open(path)
+	if err != nil {
+		client.reset(c, err)
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &remoteFile{File: f, client: client, sftp: c}, nil
+}
+
+// remoteFile resets the connection of the client when a read fails on it.
+type remoteFile struct {
+	*sftp.File
+	client *SSHClient
+	sftp   *sftp.Client
+}
+
+func (f *remoteFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.client.reset(f.sftp, err)
+	return n, err
+}
+
+func (f *remoteFile) WriteTo(w io.Writer) (int64, error) {
+	n, err := f.File.WriteTo(w)
+	f.client.reset(f.sftp, err)
+	return n, err
+}
+
+// Download copies the remote file as it is into localFile.
+// The file is written to localFile.part first, an interrupted download is resumed from its size.
+func (client *SSHClient) Download(localFile, remoteFile string) error {
+	info, err := client.Stat(remoteFile)
+	if err != nil {
 		return err
 	}
-	defer session.Close()
-	iw, err := session.StdinPipe()
+	part := localFile + ".part"
+	dst, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		log.Println("Failed to create input pipe: " + err.Error())
 		return err
 	}
-	or, err := session.StdoutPipe()
+	defer dst.Close()
+	offset, err := dst.Seek(0, io.SeekEnd)
 	if err != nil {
-		log.Println("Failed to create output pipe: " + err.Error())
 		return err
 	}
-	src, srcErr := os.Create(localFile)
-	if srcErr != nil {
-		log.Println("Failed to create source file: " + srcErr.Error())
-		return srcErr
+	if offset > info.Size() {
+		log.Printf("Local file is bigger than remote, download again: %s\n", remoteFile)
+		if err := dst.Truncate(0); err != nil {
+			return err
+		}
+		if offset, err = dst.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
 	}
-	go func() {
-		fmt.Fprint(iw, "\x00")
-		r, err := gzip.NewReader(or)
+	if offset < info.Size() {
+		if offset > 0 {
+			log.Printf("Resume download from %d: %s\n", offset, remoteFile)
+		}
+		src, err := client.Open(remoteFile, offset)
 		if err != nil {
-			log.Println("Failed to read gzip: " + err.Error())
-			return
+			return err
 		}
-		if n, err := io.Copy(src, r); err != nil {
-			fmt.Println(n)
-			fmt.Fprint(iw, "\x02")
-			return
+		defer src.Close()
+		if _, err := io.Copy(dst, src); err != nil {
+			return fmt.Errorf("unable to download %s: %w", remoteFile, err)
 		}
-		fmt.Fprint(iw, "\x00")
-	}()
-	cmd := fmt.Sprintf("xzcat %s |sed -re 's/(.*) requestBody=\".*\" (serveTime.*)/\\1 \\2/' |gzip -qc ", targetFile)
-	if !strings.HasSuffix(targetFile, ".xz") {
-		cmd = cmd[2:]
 	}
-	return session.Run(cmd)
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, localFile)
+}
+
+func (client *SSHClient) Close() error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.close()
+}
+
+func (client *SSHClient) close() error {
+	if client.sftp != nil {
+		client.sftp.Close()
+		client.sftp = nil
+	}
+	if client.conn == nil {
+		return nil
+	}
+	err := client.conn.Close()
+	client.conn = nil
+	closeAll(client.hops)
+	client.hops = nil
+	return err
 }
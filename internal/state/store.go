@@ -0,0 +1,104 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File is the shipping state of a remote file.
+type File struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Checksum is the sha256 of the remote content, empty when the file was not read from the beginning.
+	Checksum string `json:"checksum,omitempty"`
+	// Offset is the number of decompressed bytes already shipped.
+	Offset int64 `json:"offset"`
+	Done   bool  `json:"done"`
+	// Head is the sha256 of the first line of a file followed by the tail command,
+	// the file was rotated when it starts with another line.
+	Head string `json:"head,omitempty"`
+}
+
+// Unchanged reports whether the remote file has the same size and modification time.
+func (f File) Unchanged(size int64, modTime time.Time) bool {
+	return f.Size == size && f.ModTime.Equal(modTime)
+}
+
+// Store keeps the state of the remote files in a JSON file.
+type Store struct {
+	path  string
+	lock  sync.Mutex
+	files map[string]File
+}
+
+// Open loads the state file, a missing file is an empty state.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		files: make(map[string]File),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.files); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Get(path string) (File, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f, ok := s.files[path]
+	return f, ok
+}
+
+// Set stores the state of the file and writes the state file.
+func (s *Store) Set(path string, f File) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[path] = f
+	return s.save()
+}
+
+func (s *Store) Delete(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.files, path)
+	return s.save()
+}
+
+// save replaces the state file atomically, so a crash never leaves a half written state.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.files, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
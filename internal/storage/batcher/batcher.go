@@ -0,0 +1,415 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/internal/storage/wal"
+)
+
+// Backend encodes the lines and writes the batches of a Batcher.
+type Backend interface {
+	// Encode converts the line into the value of an entry with the size counted for the batch size.
+	// The lines which can not be encoded are refused by Send.
+	Encode(line storage.LogLine) (value interface{}, size int, err error)
+	// Write writes the batch and reports its delivered and rejected entries to it.
+	// It returns the number of the entries which were neither delivered nor rejected, with a WAL they are written again later.
+	// The backends knowing which entries failed report them with Fail, so the entries before the first one are not written again.
+	Write(ctx context.Context, batch *Batch) (failed int, err error)
+}
+
+// Entry is an encoded line of a batch.
+type Entry struct {
+	Value interface{}
+	// Line is kept only to report it when the entry is rejected.
+	Line storage.LogLine
+	size int
+	// index of the entry in its batch.
+	index int
+	// mark is the WAL position after the line of the entry.
+	mark wal.Mark
+}
+
+// Batch is written by the Backend.
+type Batch struct {
+	Entries []Entry
+	b       *Batcher
+	// failed is the index of the first entry reported by Fail, -1 when there is none.
+	failed int
+}
+
+// Fail reports the entries which were neither delivered nor rejected.
+func (b *Batch) Fail(entries []Entry) {
+	for _, e := range entries {
+		if b.failed < 0 || e.index < b.failed {
+			b.failed = e.index
+		}
+	}
+}
+
+// Deliver counts the delivered entries.
+func (b *Batch) Deliver(n int) {
+	b.b.AddDelivered(n)
+}
+
+// Reject counts the rejected entries and reports them with their reasons, the last reason is used for the entries without one.
+func (b *Batch) Reject(entries []Entry, reasons ...error) {
+	b.b.AddRejected(len(entries))
+	if b.b.err == nil {
+		b.b.err = reasons[0]
+	}
+	reject := b.b.rejectFunc()
+	if reject == nil {
+		return
+	}
+	for i, e := range entries {
+		reason := reasons[len(reasons)-1]
+		if i < len(reasons) {
+			reason = reasons[i]
+		}
+		reject(e.Line, reason)
+	}
+}
+
+// RejectCount counts the rejected entries when the backend does not tell which ones they are, they are not reported.
+func (b *Batch) RejectCount(n int, reason error) {
+	b.b.AddRejected(n)
+	if b.b.err == nil {
+		b.b.err = reason
+	}
+}
+
+// Done counts the entries of a batch written at once: they are delivered without an error,
+// rejected with a permanent error and failed otherwise. It returns the result of Write.
+func (b *Batch) Done(err error) (int, error) {
+	switch {
+	case err == nil:
+		b.Deliver(len(b.Entries))
+		return 0, nil
+	case retry.IsPermanent(err):
+		b.Reject(b.Entries, err)
+		return 0, err
+	}
+	return len(b.Entries), err
+}
+
+var errStopped = errors.New("storage is stopped")
+
+// Batcher is the storage loop shared by the backends: it queues the lines or reads them from the WAL,
+// writes them in batches by size and time, and counts the delivered, rejected and failed entries.
+type Batcher struct {
+	storage.Counters
+	backend        Backend
+	log            xlog.Logger
+	batch          []Entry
+	batchWait      time.Duration
+	batchTimer     *time.Timer
+	batchSize      int
+	maxSize        int
+	entriesChannel chan Entry
+	done           chan struct{}
+	flushes        chan chan error
+	// reject is the storage.RejectFunc, it is set while the loop runs.
+	reject atomic.Value
+	// lock guards stopped, the entries channel is closed by Stop when no Send is sending to it.
+	lock    sync.RWMutex
+	stopped bool
+	// started is closed by the first OnReject, Send, Flush or Stop, the loop waits for it,
+	// so the lines left in the WAL by the previous run are read with the reject function set.
+	started   chan struct{}
+	startOnce sync.Once
+	// ctx of the writes is cancelled when Stop gives up.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wal is optional, Send appends to it and the batch is read from it.
+	wal       *wal.WAL
+	walPaused bool
+	// err is the first write error since the previous Flush.
+	err     error
+	lastErr error
+	// undelivered entries are counted by the run loop, it is read by Stop when the loop is done.
+	undelivered int64
+	// kept entries of the last failed batch are in the WAL.
+	kept int
+}
+
+// New starts the loop writing the batches of the backend, w is optional.
+func New(log xlog.Logger, backend Backend, entryBufferSize int, batchSize int, batchWait time.Duration, w *wal.WAL) *Batcher {
+	b := &Batcher{
+		backend:        backend,
+		log:            log,
+		maxSize:        batchSize,
+		batchWait:      batchWait,
+		entriesChannel: make(chan Entry, entryBufferSize),
+		done:           make(chan struct{}),
+		flushes:        make(chan chan error),
+		wal:            w,
+		started:        make(chan struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	go b.run()
+
+	return b
+}
+
+// Send queues the line, the lines which can not be encoded are refused.
+func (b *Batcher) Send(ctx context.Context, line storage.LogLine) error {
+	b.start()
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.stopped {
+		return errStopped
+	}
+	e, err := b.entry(line)
+	if err != nil {
+		return err
+	}
+	if b.wal != nil {
+		return b.wal.Append(ctx, line)
+	}
+	select {
+	case b.entriesChannel <- e:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *Batcher) entry(line storage.LogLine) (Entry, error) {
+	value, size, err := b.backend.Encode(line)
+	if err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Value: value, size: size}
+	if b.rejectFunc() != nil {
+		e.Line = storage.LogLine{
+			App:    line.App,
+			Tags:   line.Tags,
+			Time:   line.Time,
+			Origin: line.Origin,
+		}
+	}
+	return e, nil
+}
+
+// OnReject sets the function called with the lines refused by the backend.
+// It is set before the lines of the WAL are read, when it is called before the first Send.
+func (b *Batcher) OnReject(fn storage.RejectFunc) {
+	b.reject.Store(fn)
+	b.start()
+}
+
+func (b *Batcher) rejectFunc() storage.RejectFunc {
+	fn, _ := b.reject.Load().(storage.RejectFunc)
+	return fn
+}
+
+// start lets the loop run.
+func (b *Batcher) start() {
+	b.startOnce.Do(func() {
+		close(b.started)
+	})
+}
+
+// Flush writes the queued lines and returns the first write error since the previous Flush.
+func (b *Batcher) Flush(ctx context.Context) error {
+	b.start()
+	reply := make(chan error, 1)
+	select {
+	case b.flushes <- reply:
+	case <-b.done:
+		return errStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop sends the remaining lines until the context is done, the lines of the WAL which could not be sent are kept for the next start.
+func (b *Batcher) Stop(ctx context.Context) error {
+	b.start()
+	b.lock.Lock()
+	if !b.stopped {
+		b.stopped = true
+		close(b.entriesChannel)
+	}
+	b.lock.Unlock()
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		// the remaining batches fail without being sent
+		b.cancel()
+		<-b.done
+	}
+	b.cancel()
+	if b.wal != nil {
+		if err := b.wal.Close(); err != nil {
+			b.log.Error("Unable to close wal: ", err)
+		}
+	}
+	if b.undelivered > 0 {
+		return &storage.UndeliveredError{Entries: b.undelivered, Err: b.lastErr}
+	}
+	return nil
+}
+
+func (b *Batcher) run() {
+	<-b.started
+	b.batchTimer = time.NewTimer(b.batchWait)
+	defer func() {
+		b.walPaused = false
+		b.drain()
+		if len(b.batch) > 0 {
+			b.flush()
+		}
+		if b.walPaused {
+			b.undelivered += int64(b.kept)
+			b.lastErr = fmt.Errorf("kept in the wal: %w", b.lastErr)
+		}
+		close(b.done)
+	}()
+
+	var walNotify <-chan struct{}
+	if b.wal != nil {
+		walNotify = b.wal.Notify()
+	}
+	for {
+		select {
+		case e, ok := <-b.entriesChannel:
+			if !ok {
+				return
+			}
+			b.add(e)
+		case <-walNotify:
+			b.drain()
+		case reply := <-b.flushes:
+			for queued := true; queued; {
+				select {
+				case e, ok := <-b.entriesChannel:
+					if queued = ok; ok {
+						b.add(e)
+					}
+				default:
+					queued = false
+				}
+			}
+			b.tick()
+			reply <- b.err
+			b.err = nil
+		case <-b.batchTimer.C:
+			b.tick()
+		}
+	}
+}
+
+// tick writes the batch with the lines of the WAL, the WAL is read again after a failed write.
+func (b *Batcher) tick() {
+	if b.wal != nil {
+		if err := b.wal.Sync(); err != nil {
+			b.log.Error("Unable to sync wal: ", err)
+		}
+		b.walPaused = false
+		b.drain()
+	}
+	if len(b.batch) > 0 {
+		b.flush()
+	}
+	b.batchTimer.Reset(b.batchWait)
+}
+
+// add adds the entry to the batch before the batch is written by its size,
+// so the lines read from the WAL are committed only with the batch they are in.
+func (b *Batcher) add(e Entry) {
+	b.batch = append(b.batch, e)
+	b.batchSize += e.size
+	if b.batchSize > b.maxSize {
+		b.flush()
+	}
+}
+
+// drain adds the lines of the WAL to the batch, it stops after a failed write until the next tick of the timer.
+func (b *Batcher) drain() {
+	for b.wal != nil && !b.walPaused {
+		line, ok, err := b.wal.Next()
+		var corrupt *wal.CorruptError
+		if errors.As(err, &corrupt) {
+			// the line is lost, it is counted as failed
+			b.log.Error("Corrupt record in wal: ", err)
+			b.AddFailed(1)
+			continue
+		}
+		if err != nil {
+			b.log.Error("Unable to read wal: ", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		e, err := b.entry(line)
+		if err != nil {
+			b.log.Error("Invalid line in wal: ", err)
+			continue
+		}
+		e.mark = b.wal.Mark()
+		b.add(e)
+	}
+}
+
+// flush writes the batch, the WAL is committed when it was delivered or rejected, otherwise it is read again later.
+func (b *Batcher) flush() {
+	batch := &Batch{Entries: b.batch, b: b, failed: -1}
+	for i := range batch.Entries {
+		batch.Entries[i].index = i
+	}
+	b.batch = nil
+	b.batchSize = 0
+	failed, err := len(batch.Entries), b.ctx.Err()
+	if err == nil {
+		failed, err = b.backend.Write(b.ctx, batch)
+	}
+	b.batchTimer.Reset(b.batchWait)
+	if err != nil {
+		b.lastErr = err
+		if b.err == nil {
+			b.err = err
+		}
+	}
+	if failed > 0 {
+		b.AddFailed(failed)
+		if b.wal == nil {
+			b.undelivered += int64(failed)
+		}
+	}
+	if b.wal == nil {
+		return
+	}
+	if failed > 0 {
+		// the entries before the first failed one are committed, the delivered entries after it are written again
+		b.kept = failed
+		if batch.failed > 0 {
+			if err := b.wal.CommitTo(batch.Entries[batch.failed-1].mark); err != nil {
+				b.log.Error("Unable to commit wal: ", err)
+			}
+		}
+		b.wal.Rewind()
+		b.walPaused = true
+		return
+	}
+	b.kept = 0
+	if err := b.wal.Commit(); err != nil {
+		b.log.Error("Unable to commit wal: ", err)
+	}
+}
@@ -0,0 +1,249 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/internal/storage/wal"
+)
+
+// backend writes the values of the lines, the first failures writes fail with err.
+type backend struct {
+	lock     sync.Mutex
+	failures int
+	err      error
+	written  []string
+}
+
+func (b *backend) Encode(line storage.LogLine) (interface{}, int, error) {
+	return line.Fields["raw"], line.Size, nil
+}
+
+func (b *backend) Write(ctx context.Context, batch *Batch) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures > 0 {
+		b.failures--
+		return batch.Done(b.err)
+	}
+	for _, e := range batch.Entries {
+		b.written = append(b.written, e.Value.(string))
+	}
+	return batch.Done(nil)
+}
+
+func line(raw string) storage.LogLine {
+	return storage.LogLine{
+		App:    "app",
+		Fields: map[string]interface{}{"raw": raw},
+		Time:   time.Now(),
+		Size:   len(raw),
+		Origin: storage.Origin{Raw: raw},
+	}
+}
+
+func TestWALSizeFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := wal.Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &backend{failures: 1, err: errors.New("unavailable")}
+	// the third line exceeds the batch size, the batch is written when it is read from the WAL
+	b := New(xlog.NopLogger, be, 10, 2, time.Hour, w)
+	ctx := context.Background()
+	for _, raw := range []string{"a", "b", "c"} {
+		if err := b.Send(ctx, line(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3 && b.Flush(ctx) != nil; i++ {
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := be.written; len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("written %v, want [a b c]", got)
+	}
+	if s := b.Stats(); s.Delivered != 3 || s.Failed != 3 {
+		t.Fatalf("stats %+v, want 3 delivered and 3 failed", s)
+	}
+
+	w, err = wal.Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if l, ok, err := w.Next(); ok || err != nil {
+		t.Fatalf("line %q left in the wal: %v", l.Origin.Raw, err)
+	}
+}
+
+func TestReject(t *testing.T) {
+	be := &backend{failures: 1, err: retry.Permanent(errors.New("invalid"))}
+	b := New(xlog.NopLogger, be, 10, 100, time.Hour, nil)
+	var rejected []string
+	b.OnReject(func(line storage.LogLine, reason error) {
+		rejected = append(rejected, line.Origin.Raw)
+	})
+	ctx := context.Background()
+	for _, raw := range []string{"a", "b"} {
+		if err := b.Send(ctx, line(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(ctx); !retry.IsPermanent(err) {
+		t.Fatalf("flush error %v, want the rejection", err)
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Fatalf("flush error %v, want nil after the reported rejection", err)
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 || rejected[0] != "a" || rejected[1] != "b" {
+		t.Fatalf("rejected %v, want [a b]", rejected)
+	}
+	if s := b.Stats(); s.Rejected != 2 || s.Delivered != 0 || s.Failed != 0 {
+		t.Fatalf("stats %+v, want 2 rejected", s)
+	}
+}
+
+// partialBackend fails the entries of the failing values once, the other entries are delivered.
+type partialBackend struct {
+	lock    sync.Mutex
+	failing map[string]bool
+	writes  [][]string
+}
+
+func (b *partialBackend) Encode(line storage.LogLine) (interface{}, int, error) {
+	return line.Fields["raw"], line.Size, nil
+}
+
+func (b *partialBackend) Write(ctx context.Context, batch *Batch) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var written []string
+	var failed []Entry
+	for _, e := range batch.Entries {
+		written = append(written, e.Value.(string))
+		if b.failing[e.Value.(string)] {
+			delete(b.failing, e.Value.(string))
+			failed = append(failed, e)
+		}
+	}
+	b.writes = append(b.writes, written)
+	batch.Deliver(len(batch.Entries) - len(failed))
+	if len(failed) == 0 {
+		return 0, nil
+	}
+	batch.Fail(failed)
+	return len(failed), errors.New("unavailable")
+}
+
+func TestWALPartialFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := wal.Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &partialBackend{failing: map[string]bool{"c": true}}
+	b := New(xlog.NopLogger, be, 10, 100, time.Hour, w)
+	ctx := context.Background()
+	for _, raw := range []string{"a", "b", "c", "d"} {
+		if err := b.Send(ctx, line(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(ctx); err == nil {
+		t.Fatal("flush without the failure")
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the lines before the failed one are committed
+	want := [][]string{{"a", "b", "c", "d"}, {"c", "d"}}
+	if !reflect.DeepEqual(be.writes, want) {
+		t.Fatalf("writes %v, want %v", be.writes, want)
+	}
+}
+
+func TestSendAfterStop(t *testing.T) {
+	b := New(xlog.NopLogger, &backend{}, 1, 100, time.Hour, nil)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the lines sent while stopping are sent or refused
+			for b.Send(ctx, line("a")) == nil {
+			}
+		}()
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := b.Send(ctx, line("b")); err != errStopped {
+		t.Fatalf("send error %v, want the stopped storage", err)
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatalf("second stop error %v", err)
+	}
+}
+
+func TestWALReject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := wal.Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// the lines left by the previous run
+	for _, raw := range []string{"a", "b"} {
+		if err := w.Append(ctx, line(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	be := &backend{failures: 1, err: retry.Permanent(errors.New("invalid"))}
+	b := New(xlog.NopLogger, be, 10, 100, time.Hour, w)
+	var rejected []string
+	b.OnReject(func(line storage.LogLine, reason error) {
+		rejected = append(rejected, line.Origin.Raw)
+	})
+	if err := b.Flush(ctx); !retry.IsPermanent(err) {
+		t.Fatalf("flush error %v, want the rejection", err)
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 || rejected[0] != "a" || rejected[1] != "b" {
+		t.Fatalf("rejected %v, want [a b]", rejected)
+	}
+}
@@ -0,0 +1,260 @@
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/internal/storage/batcher"
+	"github.com/Ak-Army/logcollector/internal/storage/wal"
+)
+
+type batchClient struct {
+	*batcher.Batcher
+	client   *Client
+	database string
+	log      xlog.Logger
+	retry    retry.Policy
+	// tables are the known tables by app, they are dropped from it with the table.
+	lock   sync.Mutex
+	tables map[string]*table
+}
+
+// New returns the ClickHouse storage writing a table per app over the HTTP interface, w is optional.
+// The tables are created and their columns are added for the new tags and fields on the fly,
+// an integer column is widened when a field gets fractional or string values later.
+func New(log xlog.Logger, conf Config, entryBufferSize int, batchSize int, batchWait time.Duration, policy retry.Policy, w *wal.WAL) storage.Storage {
+	c := &batchClient{
+		client:   NewClient(conf),
+		database: conf.Database,
+		log:      log,
+		retry:    policy,
+		tables:   make(map[string]*table),
+	}
+	c.Batcher = batcher.New(log, c, entryBufferSize, batchSize, batchWait, w)
+	return c
+}
+
+// Encode returns the line, its row is made by the table of the app.
+func (c *batchClient) Encode(line storage.LogLine) (interface{}, int, error) {
+	return line, line.Size, nil
+}
+
+func (c *batchClient) tableName(app string) string {
+	return quote(c.database) + "." + quote(app)
+}
+
+func (c *batchClient) DropDatabase(ctx context.Context) error {
+	c.log.Debugf("Drop database: %s", c.database)
+	c.lock.Lock()
+	c.tables = make(map[string]*table)
+	c.lock.Unlock()
+	_, err := c.client.exec(ctx, "DROP DATABASE IF EXISTS "+quote(c.database), nil)
+	return err
+}
+
+func (c *batchClient) DropApp(ctx context.Context, app string) error {
+	c.log.Debugf("Drop table: %s", app)
+	c.lock.Lock()
+	delete(c.tables, app)
+	c.lock.Unlock()
+	_, err := c.client.exec(ctx, "DROP TABLE IF EXISTS "+c.tableName(app), nil)
+	return err
+}
+
+// DeleteByDate deletes the rows of the range, the rows inserted after it are kept.
+// The partitions of the whole days of the range are dropped, the rows of the partial days at its edges are deleted
+// by a mutation waited for, so the rows of a rerun are not deleted by a pending mutation.
+func (c *batchClient) DeleteByDate(ctx context.Context, app string, dateFrom, dateTo time.Time) error {
+	c.log.Debugf("Delete by date: %s %s->%s", app, dateFrom, dateTo)
+	err := c.deleteByDate(ctx, c.tableName(app), dateFrom, dateTo)
+	if exceptionCode(err) == unknownTable {
+		return nil
+	}
+	if err != nil {
+		c.log.Error("Unable to delete by date", err)
+		return err
+	}
+	return nil
+}
+
+func (c *batchClient) deleteByDate(ctx context.Context, name string, dateFrom, dateTo time.Time) error {
+	// the partitions are the days in UTC
+	first := dateFrom.UTC().Truncate(24 * time.Hour)
+	if first.Before(dateFrom) {
+		first = first.AddDate(0, 0, 1)
+	}
+	last := dateTo.UTC().Truncate(24 * time.Hour)
+	if !first.Before(last) {
+		return c.deleteRows(ctx, name, dateFrom, dateTo)
+	}
+	if first.After(dateFrom) {
+		if err := c.deleteRows(ctx, name, dateFrom, first); err != nil {
+			return err
+		}
+	}
+	var drops []string
+	for day := first; day.Before(last); day = day.AddDate(0, 0, 1) {
+		drops = append(drops, "DROP PARTITION "+day.Format("20060102"))
+	}
+	if _, err := c.client.exec(ctx, "ALTER TABLE "+name+" "+strings.Join(drops, ", "), nil); err != nil {
+		return err
+	}
+	if dateTo.After(last) {
+		return c.deleteRows(ctx, name, last, dateTo)
+	}
+	return nil
+}
+
+// deleteRows deletes the rows of the half-open range, it returns when the mutation is done.
+func (c *batchClient) deleteRows(ctx context.Context, name string, dateFrom, dateTo time.Time) error {
+	_, err := c.client.execSettings(ctx, "ALTER TABLE "+name+" DELETE WHERE "+
+		quote(timestampColumn)+" >= "+timestamp(dateFrom)+" AND "+
+		quote(timestampColumn)+" < "+timestamp(dateTo), url.Values{"mutations_sync": {"1"}}, nil)
+	return err
+}
+
+// Write inserts the lines of every app into its table.
+// After a failure the delivered lines after the first failed one are sent again, the tables deduplicate the same inserts only.
+func (c *batchClient) Write(ctx context.Context, batch *batcher.Batch) (int, error) {
+	lines := make(map[string][]batcher.Entry)
+	for _, e := range batch.Entries {
+		app := e.Value.(storage.LogLine).App
+		lines[app] = append(lines[app], e)
+	}
+	apps := make([]string, 0, len(lines))
+	for app := range lines {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	failed := 0
+	var first error
+	for _, app := range apps {
+		n, err := c.insert(ctx, batch, app, lines[app])
+		failed += n
+		if err != nil {
+			c.log.Errorf("Unable to insert into %s: %s", app, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return failed, first
+}
+
+// insert writes the lines of the app, the lines not matching the column types even after widening them are rejected.
+// It returns the number of the lines which were not delivered and not rejected either.
+func (c *batchClient) insert(ctx context.Context, batch *batcher.Batch, app string, entries []batcher.Entry) (int, error) {
+	if err := ctx.Err(); err != nil {
+		batch.Fail(entries)
+		return len(entries), err
+	}
+	var t *table
+	err := c.retry.Do(ctx, func() error {
+		var err error
+		t, err = c.table(ctx, app)
+		return err
+	}, c.onRetry)
+	if err != nil {
+		if retry.IsPermanent(err) {
+			batch.Reject(entries, err)
+			return 0, err
+		}
+		batch.Fail(entries)
+		return len(entries), err
+	}
+
+	var fitting, invalid []batcher.Entry
+	var reasons []error
+	for _, e := range entries {
+		if err := t.fit(e.Value.(storage.LogLine)); err != nil {
+			invalid = append(invalid, e)
+			reasons = append(reasons, err)
+			continue
+		}
+		fitting = append(fitting, e)
+	}
+	var body bytes.Buffer
+	var rows []batcher.Entry
+	for _, e := range fitting {
+		row, err := t.row(e.Value.(storage.LogLine))
+		if err != nil {
+			invalid = append(invalid, e)
+			reasons = append(reasons, err)
+			continue
+		}
+		body.Write(row)
+		body.WriteByte('\n')
+		rows = append(rows, e)
+	}
+	if len(invalid) > 0 {
+		batch.Reject(invalid, reasons...)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	err = c.retry.Do(ctx, func() error {
+		if query := t.alterQuery(); query != "" {
+			if _, err := c.client.exec(ctx, query, nil); err != nil {
+				return err
+			}
+			t.added = nil
+			t.widened = nil
+		}
+		_, err := c.client.exec(ctx, "INSERT INTO "+t.name+" FORMAT JSONEachRow", body.Bytes())
+		return err
+	}, c.onRetry)
+	switch {
+	case err == nil:
+		batch.Deliver(len(rows))
+		return 0, nil
+	case retry.IsPermanent(err):
+		batch.Reject(rows, err)
+		return 0, err
+	}
+	batch.Fail(rows)
+	return len(rows), err
+}
+
+func (c *batchClient) onRetry(attempt int, err error) {
+	c.log.Warnf("Unable to insert, retry %d: %s", attempt, err)
+}
+
+// table returns the table of the app, it is created with the database when it does not exist.
+func (c *batchClient) table(ctx context.Context, app string) (*table, error) {
+	c.lock.Lock()
+	t, ok := c.tables[app]
+	c.lock.Unlock()
+	if ok {
+		return t, nil
+	}
+	if _, err := c.client.exec(ctx, "CREATE DATABASE IF NOT EXISTS "+quote(c.database), nil); err != nil {
+		return nil, err
+	}
+	t = &table{
+		name:    c.tableName(app),
+		columns: make(map[string]string),
+	}
+	if _, err := c.client.exec(ctx, createQuery(t.name), nil); err != nil {
+		return nil, err
+	}
+	columns, err := c.client.describe(ctx, t.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range columns {
+		t.columns[col.Name] = col.Type
+	}
+	c.lock.Lock()
+	c.tables[app] = t
+	c.lock.Unlock()
+	return t, nil
+}
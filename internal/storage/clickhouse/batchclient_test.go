@@ -0,0 +1,300 @@
+package clickhouse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// server is a fake ClickHouse, it keeps the columns of the tables and the inserted rows.
+// The inserts of a row with an invalid raw fail with CANNOT_PARSE_INPUT_ASSERTION_FAILED.
+type server struct {
+	lock    sync.Mutex
+	queries []string
+	tables  map[string][]column
+	rows    []map[string]interface{}
+	// lines are the inserted rows as they were sent.
+	lines []string
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	query := r.URL.Query().Get("query")
+	if r.URL.Query().Get("mutations_sync") != "" {
+		query += " [mutations_sync=" + r.URL.Query().Get("mutations_sync") + "]"
+	}
+	s.queries = append(s.queries, query)
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case strings.HasPrefix(query, "CREATE DATABASE"):
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS "):
+		name := strings.Fields(query)[5]
+		if _, ok := s.tables[name]; !ok {
+			s.tables[name] = []column{{"timestamp", "DateTime64(9, 'UTC')"}, {"host", tagType}, {"raw", "String"}}
+		}
+	case strings.HasPrefix(query, "DESCRIBE TABLE "):
+		for _, col := range s.tables[strings.Fields(query)[2]] {
+			json.NewEncoder(w).Encode(col)
+		}
+	case strings.HasPrefix(query, "INSERT INTO "):
+		var rows []map[string]interface{}
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var row map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &row)
+			if row["raw"] == "invalid" {
+				w.Header().Set("X-ClickHouse-Exception-Code", "27")
+				http.Error(w, "Code: 27. DB::Exception: Cannot parse input", http.StatusInternalServerError)
+				return
+			}
+			rows = append(rows, row)
+			s.lines = append(s.lines, scanner.Text())
+		}
+		s.rows = append(s.rows, rows...)
+	case strings.HasPrefix(query, "ALTER TABLE `log`.`none` "):
+		w.Header().Set("X-ClickHouse-Exception-Code", unknownTable)
+		http.Error(w, "Code: 60. DB::Exception: Table log.none doesn't exist", http.StatusNotFound)
+	case strings.HasPrefix(query, "ALTER TABLE "):
+	default:
+		http.Error(w, "Code: 62. DB::Exception: Syntax error", http.StatusBadRequest)
+	}
+}
+
+func newTestClient(s *server) (*batchClient, func()) {
+	srv := httptest.NewServer(s)
+	c := New(xlog.NopLogger, Config{URL: srv.URL, Database: "log"}, 10, 1<<20, time.Hour, retry.Policy{Attempts: 2}, nil)
+	return c.(*batchClient), func() {
+		c.Stop(context.Background())
+		srv.Close()
+	}
+}
+
+func line(raw string, fields map[string]interface{}) storage.LogLine {
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["raw"] = raw
+	return storage.LogLine{
+		App:    "app",
+		Tags:   map[string]string{"host": "web1"},
+		Fields: fields,
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Origin: storage.Origin{File: "/var/log/app.log", Line: 1, Raw: raw},
+	}
+}
+
+func TestInsert(t *testing.T) {
+	s := &server{tables: make(map[string][]column)}
+	c, stop := newTestClient(s)
+	defer stop()
+	ctx := context.Background()
+	lines := []storage.LogLine{
+		line("first", map[string]interface{}{"status": 200}),
+		line("second", map[string]interface{}{"took": 0.5}),
+	}
+	for _, l := range lines {
+		if err := c.Send(ctx, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// an integer field gets fractional values later
+	if err := c.Send(ctx, line("third", map[string]interface{}{"status": 1.5})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CREATE DATABASE IF NOT EXISTS `log`",
+		createQuery("`log`.`app`"),
+		"DESCRIBE TABLE `log`.`app` FORMAT JSONEachRow",
+		"ALTER TABLE `log`.`app` ADD COLUMN IF NOT EXISTS `status` Int64, ADD COLUMN IF NOT EXISTS `took` Float64",
+		"INSERT INTO `log`.`app` FORMAT JSONEachRow",
+		"ALTER TABLE `log`.`app` MODIFY COLUMN `status` Float64",
+		"INSERT INTO `log`.`app` FORMAT JSONEachRow",
+	}
+	if !reflect.DeepEqual(s.queries, want) {
+		t.Errorf("queries\n%q\nwant\n%q", s.queries, want)
+	}
+	timestamp := "2020-01-02 03:04:05.000000000"
+	rows := []map[string]interface{}{
+		{"timestamp": timestamp, "host": "web1", "raw": "first", "status": 200.0},
+		{"timestamp": timestamp, "host": "web1", "raw": "second", "took": 0.5},
+		{"timestamp": timestamp, "host": "web1", "raw": "third", "status": 1.5},
+	}
+	if !reflect.DeepEqual(s.rows, rows) {
+		t.Errorf("rows %v, want %v", s.rows, rows)
+	}
+	if st := c.Stats(); st.Delivered != 3 {
+		t.Errorf("stats %+v, want 3 delivered", st)
+	}
+}
+
+func TestLargeIntegers(t *testing.T) {
+	s := &server{tables: make(map[string][]column)}
+	c, stop := newTestClient(s)
+	defer stop()
+	var rejected []string
+	c.OnReject(func(line storage.LogLine, reason error) {
+		rejected = append(rejected, line.Origin.Raw)
+	})
+	ctx := context.Background()
+	lines := []storage.LogLine{
+		// the first values of id and bytes are integers, they are widened by the next lines of the batch
+		line("first", map[string]interface{}{"id": int64(1<<53 + 1), "bytes": int64(512)}),
+		line("second", map[string]interface{}{"bytes": 0.5, "took": 0.5}),
+		// it would lose its precision in the Float64 column
+		line("third", map[string]interface{}{"took": int64(1<<53 + 1)}),
+		line("fourth", map[string]interface{}{"id": "none"}),
+	}
+	for _, l := range lines {
+		if err := c.Send(ctx, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(ctx); err == nil {
+		t.Fatal("flush without the error of the rejected lines")
+	}
+	want := []string{
+		"CREATE DATABASE IF NOT EXISTS `log`",
+		createQuery("`log`.`app`"),
+		"DESCRIBE TABLE `log`.`app` FORMAT JSONEachRow",
+		"ALTER TABLE `log`.`app` ADD COLUMN IF NOT EXISTS `id` String, ADD COLUMN IF NOT EXISTS `bytes` Float64, ADD COLUMN IF NOT EXISTS `took` Float64",
+		"INSERT INTO `log`.`app` FORMAT JSONEachRow",
+	}
+	// the order of the columns of a line is random
+	if len(s.queries) == len(want) {
+		alter := strings.TrimPrefix(s.queries[3], "ALTER TABLE `log`.`app` ")
+		adds := strings.Split(alter, ", ")
+		sort.Strings(adds)
+		s.queries[3] = "ALTER TABLE `log`.`app` " + strings.Join(adds, ", ")
+		adds = strings.Split(strings.TrimPrefix(want[3], "ALTER TABLE `log`.`app` "), ", ")
+		sort.Strings(adds)
+		want[3] = "ALTER TABLE `log`.`app` " + strings.Join(adds, ", ")
+	}
+	if !reflect.DeepEqual(s.queries, want) {
+		t.Errorf("queries\n%q\nwant\n%q", s.queries, want)
+	}
+	if want := []string{"first", "second", "fourth"}; len(s.rows) != 3 || s.rows[0]["raw"] != want[0] || s.rows[1]["raw"] != want[1] || s.rows[2]["raw"] != want[2] {
+		t.Fatalf("rows %v, want %v", s.rows, want)
+	}
+	if !strings.Contains(s.lines[0], `"id":"9007199254740993"`) {
+		t.Errorf("row %s, want the exact id", s.lines[0])
+	}
+	if want := []string{"third"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected %v, want %v", rejected, want)
+	}
+
+	// the widened column keeps the exact integers
+	if err := c.Send(ctx, line("fifth", map[string]interface{}{"count": int64(1<<62 + 1)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if last := s.lines[len(s.lines)-1]; !strings.Contains(last, `"count":4611686018427387905`) {
+		t.Errorf("row %s, want the exact count", last)
+	}
+}
+
+func TestRejectedRows(t *testing.T) {
+	s := &server{tables: map[string][]column{
+		"`log`.`app`": {{"timestamp", "DateTime64(9, 'UTC')"}, {"host", tagType}, {"raw", "String"}, {"ok", "Bool"}},
+	}}
+	c, stop := newTestClient(s)
+	defer stop()
+	var rejected []string
+	c.OnReject(func(line storage.LogLine, reason error) {
+		rejected = append(rejected, line.Origin.Raw)
+	})
+	ctx := context.Background()
+	// the value does not fit the existing column
+	if err := c.Send(ctx, line("conflict", map[string]interface{}{"ok": "yes"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(ctx, line("valid", map[string]interface{}{"ok": true})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(ctx); err == nil {
+		t.Fatal("flush without the error of the rejected line")
+	}
+	if len(s.rows) != 1 || s.rows[0]["raw"] != "valid" {
+		t.Errorf("rows %v, want the valid line", s.rows)
+	}
+	// the insert is refused by ClickHouse
+	if err := c.Send(ctx, line("invalid", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(ctx); err == nil || !retry.IsPermanent(err) {
+		t.Fatalf("flush error %v, want the exception", err)
+	}
+	if want := []string{"conflict", "invalid"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected %v, want %v", rejected, want)
+	}
+	inserts := 0
+	for _, q := range s.queries {
+		if strings.HasPrefix(q, "INSERT") {
+			inserts++
+		}
+	}
+	// the refused insert is not retried
+	if inserts != 2 {
+		t.Errorf("%d inserts, want 2", inserts)
+	}
+	if st := c.Stats(); st.Delivered != 1 || st.Rejected != 2 || st.Failed != 0 {
+		t.Errorf("stats %+v, want 1 delivered and 2 rejected", st)
+	}
+}
+
+func TestDeleteByDate(t *testing.T) {
+	s := &server{tables: make(map[string][]column)}
+	c, stop := newTestClient(s)
+	defer stop()
+	ctx := context.Background()
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := c.DeleteByDate(ctx, "app", day, day.AddDate(0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// the local days do not match the partitions
+	local := time.Date(2020, 1, 2, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	if err := c.DeleteByDate(ctx, "app", local, local.AddDate(0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteByDate(ctx, "app", local, local.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// nothing was written yet
+	if err := c.DeleteByDate(ctx, "none", day, day.AddDate(0, 0, 1)); err != nil {
+		t.Errorf("delete error %v, want none", err)
+	}
+	want := []string{
+		"ALTER TABLE `log`.`app` DROP PARTITION 20200102, DROP PARTITION 20200103",
+		"ALTER TABLE `log`.`app` DELETE WHERE `timestamp` >= toDateTime64('2020-01-01 23:00:00.000000000', 9, 'UTC') AND `timestamp` < toDateTime64('2020-01-02 00:00:00.000000000', 9, 'UTC') [mutations_sync=1]",
+		"ALTER TABLE `log`.`app` DROP PARTITION 20200102",
+		"ALTER TABLE `log`.`app` DELETE WHERE `timestamp` >= toDateTime64('2020-01-03 00:00:00.000000000', 9, 'UTC') AND `timestamp` < toDateTime64('2020-01-03 23:00:00.000000000', 9, 'UTC') [mutations_sync=1]",
+		"ALTER TABLE `log`.`app` DELETE WHERE `timestamp` >= toDateTime64('2020-01-01 23:00:00.000000000', 9, 'UTC') AND `timestamp` < toDateTime64('2020-01-02 23:00:00.000000000', 9, 'UTC') [mutations_sync=1]",
+		"ALTER TABLE `log`.`none` DROP PARTITION 20200102",
+	}
+	if !reflect.DeepEqual(s.queries, want) {
+		t.Errorf("queries\n%q\nwant\n%q", s.queries, want)
+	}
+}
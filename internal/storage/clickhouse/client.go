@@ -0,0 +1,152 @@
+package clickhouse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+)
+
+// Config of the ClickHouse HTTP interface.
+type Config struct {
+	URL      string
+	Username string
+	Password string
+	Database string
+}
+
+type Client struct {
+	client *http.Client
+	conf   Config
+}
+
+// permanentCodes are the exception codes of the queries which fail the same way when they are sent again,
+// like a syntax error or a value which can not be parsed.
+var permanentCodes = map[string]bool{
+	"6":   true, // CANNOT_PARSE_TEXT
+	"26":  true, // CANNOT_PARSE_QUOTED_STRING
+	"27":  true, // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	"38":  true, // CANNOT_PARSE_DATE
+	"41":  true, // CANNOT_PARSE_DATETIME
+	"44":  true, // ILLEGAL_COLUMN
+	"53":  true, // TYPE_MISMATCH
+	"62":  true, // SYNTAX_ERROR
+	"70":  true, // CANNOT_CONVERT_TYPE
+	"72":  true, // CANNOT_PARSE_NUMBER
+	"117": true, // INCORRECT_DATA
+	"497": true, // ACCESS_DENIED
+	"516": true, // AUTHENTICATION_FAILED
+}
+
+// unknownTable is the exception code of the queries of a missing table.
+const unknownTable = "60"
+
+// exception is a failed query with the exception code of ClickHouse, the code is empty when it is not known.
+type exception struct {
+	Code string
+	err  error
+}
+
+func (e *exception) Error() string {
+	return e.err.Error()
+}
+
+// exceptionCode returns the exception code of the error of a query.
+func exceptionCode(err error) string {
+	var e *exception
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// column is a column of a table as it is described by ClickHouse.
+type column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func NewClient(conf Config) *Client {
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+	return &Client{
+		client: &http.Client{Timeout: 120 * time.Second},
+		conf:   conf,
+	}
+}
+
+// exec runs the query, the body is its data.
+func (c *Client) exec(ctx context.Context, query string, body []byte) ([]byte, error) {
+	return c.execSettings(ctx, query, nil, body)
+}
+
+// execSettings runs the query with the settings, the body is its data.
+// The client errors and the exceptions of permanentCodes are permanent, other than 429 Too Many Requests.
+func (c *Client) execSettings(ctx context.Context, query string, settings url.Values, body []byte) ([]byte, error) {
+	params := url.Values{"query": {query}}
+	for k, v := range settings {
+		params[k] = v
+	}
+	req, err := http.NewRequest(http.MethodPost, c.conf.URL+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.conf.Username != "" {
+		req.Header.Set("X-ClickHouse-User", c.conf.Username)
+		req.Header.Set("X-ClickHouse-Key", c.conf.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return data, nil
+	}
+	code := resp.Header.Get("X-ClickHouse-Exception-Code")
+	err = &exception{
+		Code: code,
+		err:  fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data)),
+	}
+	if permanentCodes[code] ||
+		resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return nil, retry.Permanent(err)
+	}
+	return nil, err
+}
+
+// describe returns the columns of the table.
+func (c *Client) describe(ctx context.Context, table string) ([]column, error) {
+	data, err := c.exec(ctx, "DESCRIBE TABLE "+table+" FORMAT JSONEachRow", nil)
+	if err != nil {
+		return nil, err
+	}
+	var columns []column
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var col column
+		if err := json.Unmarshal(scanner.Bytes(), &col); err != nil {
+			return nil, fmt.Errorf("invalid description of %s: %w", table, err)
+		}
+		columns = append(columns, col)
+	}
+	return columns, scanner.Err()
+}
+
+// quote returns the identifier quoted for the queries.
+func quote(name string) string {
+	return "`" + strings.NewReplacer(`\`, `\\`, "`", "\\`").Replace(name) + "`"
+}
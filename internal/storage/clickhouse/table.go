@@ -0,0 +1,238 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+const (
+	timestampColumn = "timestamp"
+	hostColumn      = "host"
+	rawColumn       = "raw"
+	tagType         = "LowCardinality(String)"
+)
+
+// table of an app, the columns of the new tags and fields are added on the fly.
+type table struct {
+	// name is the quoted database.table
+	name    string
+	columns map[string]string
+	// added columns are not in the table yet.
+	added []column
+	// widened columns do not have their new type in the table yet.
+	widened []column
+}
+
+// createQuery returns the query creating the table with the fixed columns, a partition is a day.
+func createQuery(name string) string {
+	return "CREATE TABLE IF NOT EXISTS " + name + " (" +
+		quote(timestampColumn) + " DateTime64(9, 'UTC'), " +
+		quote(hostColumn) + " " + tagType + ", " +
+		quote(rawColumn) + " String" +
+		") ENGINE = MergeTree PARTITION BY toYYYYMMDD(" + quote(timestampColumn) + ")" +
+		" ORDER BY (" + quote(hostColumn) + ", " + quote(timestampColumn) + ")" +
+		" SETTINGS non_replicated_deduplication_window = 100"
+}
+
+// timestampFormat is the format of the timestamp column in UTC.
+const timestampFormat = "2006-01-02 15:04:05.000000000"
+
+// timestamp returns the literal of the time compared to the timestamp column.
+func timestamp(t time.Time) string {
+	return "toDateTime64('" + t.UTC().Format(timestampFormat) + "', 9, 'UTC')"
+}
+
+// alterQuery returns the query adding the new columns and widening the columns, empty when there is none.
+func (t *table) alterQuery() string {
+	var alters []string
+	for _, col := range t.added {
+		alters = append(alters, "ADD COLUMN IF NOT EXISTS "+quote(col.Name)+" "+col.Type)
+	}
+	for _, col := range t.widened {
+		alters = append(alters, "MODIFY COLUMN "+quote(col.Name)+" "+col.Type)
+	}
+	if len(alters) == 0 {
+		return ""
+	}
+	return "ALTER TABLE " + t.name + " " + strings.Join(alters, ", ")
+}
+
+// columnsOf calls fn with the column, the value and the type of the new column of the tags and fields of the line.
+// The tags and fields named like a fixed column or, for fields, like a tag get a tag_ or field_ prefix.
+func columnsOf(line storage.LogLine, fn func(name string, v interface{}, typ string) error) error {
+	for k, v := range line.Tags {
+		name := k
+		switch k {
+		case hostColumn:
+			continue
+		case timestampColumn, rawColumn:
+			name = "tag_" + k
+		}
+		if err := fn(name, v, tagType); err != nil {
+			return fmt.Errorf("tag %s: %w", k, err)
+		}
+	}
+	for k, v := range line.Fields {
+		if k == rawColumn {
+			continue
+		}
+		name := k
+		if _, ok := line.Tags[k]; ok || k == timestampColumn || k == hostColumn {
+			name = "field_" + k
+		}
+		v = normalize(v)
+		if err := fn(name, v, fieldType(v)); err != nil {
+			return fmt.Errorf("field %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// fit adds or widens the columns of the line, so its values fit them.
+// The rows of a batch are made after all of its lines fit, the earlier rows get the widened types too.
+func (t *table) fit(line storage.LogLine) error {
+	return columnsOf(line, t.fitColumn)
+}
+
+// fitColumn adds the column with the type when it is new, an Int64 or Float64 column is widened
+// to the type of the value when the value does not fit it.
+func (t *table) fitColumn(name string, v interface{}, typ string) error {
+	existing, ok := t.columns[name]
+	if !ok {
+		t.columns[name] = typ
+		t.added = append(t.added, column{Name: name, Type: typ})
+		return nil
+	}
+	_, err := convert(v, existing)
+	if err == nil || fieldRank[existing] == 0 || fieldRank[typ] <= fieldRank[existing] {
+		return err
+	}
+	t.columns[name] = typ
+	for i, col := range t.added {
+		if col.Name == name {
+			// not in the table yet
+			t.added[i].Type = typ
+			return nil
+		}
+	}
+	for i, col := range t.widened {
+		if col.Name == name {
+			t.widened[i].Type = typ
+			return nil
+		}
+	}
+	t.widened = append(t.widened, column{Name: name, Type: typ})
+	return nil
+}
+
+// row returns the JSONEachRow line of the log line, the line must fit the table.
+func (t *table) row(line storage.LogLine) ([]byte, error) {
+	row := map[string]interface{}{
+		timestampColumn: line.Time.UTC().Format(timestampFormat),
+	}
+	if host, ok := line.Tags[hostColumn]; ok {
+		row[hostColumn] = host
+	}
+	if raw, ok := line.Fields[rawColumn]; ok {
+		row[rawColumn] = fmt.Sprint(raw)
+	}
+	err := columnsOf(line, func(name string, v interface{}, typ string) error {
+		value, err := convert(v, t.columns[name])
+		if err != nil {
+			return err
+		}
+		row[name] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(row)
+}
+
+// normalize converts the numbers to int64 and float64.
+func normalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
+
+// fieldRank orders the types of the field columns which are widened, a Bool column is not.
+var fieldRank = map[string]int{"Int64": 1, "Float64": 2, "String": 3}
+
+// fieldType returns the type of the column added for the value.
+func fieldType(v interface{}) string {
+	switch v.(type) {
+	case int64:
+		return "Int64"
+	case float64:
+		return "Float64"
+	case bool:
+		return "Bool"
+	}
+	return "String"
+}
+
+// convert returns the value for the column type, the values which would lose data are refused.
+func convert(v interface{}, typ string) (interface{}, error) {
+	base := typ
+	for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+		if strings.HasPrefix(base, wrapper) {
+			base = strings.TrimSuffix(strings.TrimPrefix(base, wrapper), ")")
+		}
+	}
+	switch {
+	case base == "String":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(v), nil
+	case strings.HasPrefix(base, "Int"), strings.HasPrefix(base, "UInt"):
+		switch n := v.(type) {
+		case int64:
+			return n, nil
+		case bool:
+			if n {
+				return 1, nil
+			}
+			return 0, nil
+		case float64:
+			if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+				return int64(n), nil
+			}
+		}
+	case strings.HasPrefix(base, "Float"), strings.HasPrefix(base, "Decimal"):
+		switch n := v.(type) {
+		case int64:
+			if n > 1<<53 || n < -1<<53 {
+				return nil, fmt.Errorf("%d does not fit a %s column", n, typ)
+			}
+			return float64(n), nil
+		case float64:
+			if math.IsNaN(n) || math.IsInf(n, 0) {
+				return nil, fmt.Errorf("invalid value: %v", n)
+			}
+			return n, nil
+		}
+	case base == "Bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	default:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%T value %v for %s column", v, v, typ)
+}
@@ -0,0 +1,157 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/internal/storage/batcher"
+	"github.com/Ak-Army/logcollector/internal/storage/wal"
+)
+
+type batchClient struct {
+	*batcher.Batcher
+	client *Client
+	prefix string
+	log    xlog.Logger
+	retry  retry.Policy
+	// templated is set when the index template was put.
+	templated bool
+}
+
+// New returns the Elasticsearch storage writing daily indices per app with the _bulk API, w is optional.
+// It works with OpenSearch too.
+func New(log xlog.Logger, conf Config, entryBufferSize int, batchSize int, batchWait time.Duration, policy retry.Policy, w *wal.WAL) storage.Storage {
+	c := &batchClient{
+		client: NewClient(conf),
+		prefix: conf.IndexPrefix,
+		log:    log,
+		retry:  policy,
+	}
+	c.Batcher = batcher.New(log, c, entryBufferSize, batchSize, batchWait, w)
+	return c
+}
+
+// Encode returns the document of the line, the lines with a field which can not be indexed are refused.
+func (c *batchClient) Encode(line storage.LogLine) (interface{}, int, error) {
+	d, err := c.document(line)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d, len(d.data), nil
+}
+
+// indices returns the daily indices of the app. The indices of the apps starting with the app and a dash
+// match its pattern too, so the names are checked.
+func (c *batchClient) indices(ctx context.Context, app string) ([]string, error) {
+	prefix := c.prefix + strings.ToLower(app) + "-"
+	names, err := c.client.indices(ctx, prefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	var own []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(indexDate, name[len(prefix):]); err == nil {
+			own = append(own, name)
+		}
+	}
+	return own, nil
+}
+
+func (c *batchClient) DropDatabase(ctx context.Context) error {
+	c.log.Debugf("Delete indices: %s*", c.prefix)
+	names, err := c.client.indices(ctx, c.prefix+"*")
+	if err != nil {
+		return err
+	}
+	return c.client.deleteIndices(ctx, names)
+}
+
+func (c *batchClient) DropApp(ctx context.Context, app string) error {
+	names, err := c.indices(ctx, app)
+	if err != nil {
+		return err
+	}
+	c.log.Debugf("Delete indices: %s", strings.Join(names, ","))
+	return c.client.deleteIndices(ctx, names)
+}
+
+func (c *batchClient) DeleteByDate(ctx context.Context, app string, dateFrom, dateTo time.Time) error {
+	c.log.Debugf("Delete by date: %s %s->%s", app, dateFrom, dateTo)
+	names, err := c.indices(ctx, app)
+	if err == nil {
+		err = c.client.deleteByQuery(ctx, names, app, dateFrom, dateTo)
+	}
+	if err != nil {
+		c.log.Error("Unable to delete by date", err)
+		return err
+	}
+	return nil
+}
+
+// Write sends the batch, only the documents failed with a temporary error are sent again by the retries.
+// After a failure the delivered documents after the first failed one are sent again, the ones read from a file are not duplicated by their id.
+func (c *batchClient) Write(ctx context.Context, batch *batcher.Batch) (int, error) {
+	pending := batch.Entries
+	err := c.retry.Do(ctx, func() error {
+		if !c.templated {
+			if err := c.client.putTemplate(ctx); err != nil {
+				if !retry.IsPermanent(err) {
+					return err
+				}
+				c.log.Warn("Unable to put index template: ", err)
+			}
+			c.templated = true
+		}
+		docs := make([]document, len(pending))
+		for i, e := range pending {
+			docs[i] = e.Value.(document)
+		}
+		items, err := c.client.bulk(ctx, docs)
+		if err != nil {
+			return err
+		}
+		var temporary, rejected []batcher.Entry
+		var reasons []error
+		var reason error
+		delivered := 0
+		for i, item := range items {
+			switch {
+			case item.Status < 300, item.Status == http.StatusConflict && docs[i].id:
+				delivered++
+			case item.Status == http.StatusTooManyRequests || item.Status >= 500:
+				temporary = append(temporary, pending[i])
+				reason = item.err()
+			default:
+				rejected = append(rejected, pending[i])
+				reasons = append(reasons, item.err())
+			}
+		}
+		batch.Deliver(delivered)
+		if len(rejected) > 0 {
+			batch.Reject(rejected, reasons...)
+		}
+		pending = temporary
+		return reason
+	}, func(attempt int, err error) {
+		c.log.Warnf("Bulk error, retry %d: %s", attempt, err)
+	})
+	if err == nil {
+		return 0, nil
+	}
+	c.log.Error("Bulk error: ", err)
+	if retry.IsPermanent(err) {
+		batch.Reject(pending, err)
+		return 0, err
+	}
+	batch.Fail(pending)
+	return len(pending), err
+}
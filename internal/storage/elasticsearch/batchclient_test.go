@@ -0,0 +1,239 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// cluster is a fake cluster, the bulk requests get the statuses of the messages of their documents.
+type cluster struct {
+	lock sync.Mutex
+	// statuses of the documents by message, one for every bulk request of the message, the last one is repeated.
+	statuses map[string][]int
+	// bulks are the messages of the bulk requests.
+	bulks    [][]string
+	requests []string
+	bodies   []string
+}
+
+func (c *cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	c.requests = append(c.requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+	c.bodies = append(c.bodies, string(body))
+	switch {
+	case r.URL.Path == "/_bulk":
+		c.bulk(w, body)
+	case strings.HasPrefix(r.URL.Path, "/_index_template/"):
+		w.Write([]byte(`{"acknowledged":true}`))
+	case r.URL.Path == "/_cat/indices/logs-app-*":
+		// the indices of the app-queue app match the pattern too
+		w.Write([]byte(`[{"index":"logs-app-2020.01.01"},{"index":"logs-app-queue-2020.01.01"},{"index":"logs-app-2020.01.02"}]`))
+	case r.URL.Path == "/_cat/indices/logs-none-*":
+		http.Error(w, `{"error":"index_not_found_exception"}`, http.StatusNotFound)
+	case strings.HasSuffix(r.URL.Path, "/_delete_by_query"), r.Method == http.MethodDelete:
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *cluster) bulk(w http.ResponseWriter, body []byte) {
+	var messages []string
+	var items []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		// the source follows the action
+		scanner.Scan()
+		var src source
+		json.Unmarshal(scanner.Bytes(), &src)
+		messages = append(messages, src.Message)
+		statuses := c.statuses[src.Message]
+		status := statuses[0]
+		if len(statuses) > 1 {
+			c.statuses[src.Message] = statuses[1:]
+		}
+		item := map[string]interface{}{"status": status}
+		if status >= 300 {
+			item["error"] = map[string]string{"type": "error", "reason": src.Message}
+		}
+		items = append(items, map[string]interface{}{"create": item})
+	}
+	c.bulks = append(c.bulks, messages)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+}
+
+func newTestClient(c *cluster) (*batchClient, func()) {
+	srv := httptest.NewServer(c)
+	s := New(xlog.NopLogger, Config{URL: srv.URL, IndexPrefix: "logs-"}, 10, 1<<20, time.Hour, retry.Policy{Attempts: 3}, nil)
+	return s.(*batchClient), func() {
+		s.Stop(context.Background())
+		srv.Close()
+	}
+}
+
+// line returns the line of the message, the lines with a line number have an id.
+func line(message string, number int) storage.LogLine {
+	return storage.LogLine{
+		App:    "app",
+		Fields: map[string]interface{}{"raw": message},
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Origin: storage.Origin{File: "/var/log/app.log", Line: number, Raw: message},
+	}
+}
+
+func TestBulkPartialFailure(t *testing.T) {
+	c := &cluster{statuses: map[string][]int{
+		"created":  {201},
+		"busy":     {429, 201},
+		"invalid":  {400},
+		"existing": {409},
+		"conflict": {409},
+	}}
+	s, stop := newTestClient(c)
+	defer stop()
+	var rejected []string
+	s.OnReject(func(line storage.LogLine, reason error) {
+		rejected = append(rejected, line.Origin.Raw)
+	})
+	ctx := context.Background()
+	lines := []storage.LogLine{
+		line("created", 1),
+		line("busy", 2),
+		line("invalid", 3),
+		// already written by a previous run
+		line("existing", 4),
+		// without an id a conflict is an error
+		line("conflict", 0),
+	}
+	for _, l := range lines {
+		if err := s.Send(ctx, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Fatalf("flush error %v, want the rejection", err)
+	}
+
+	want := [][]string{{"created", "busy", "invalid", "existing", "conflict"}, {"busy"}}
+	if !reflect.DeepEqual(c.bulks, want) {
+		t.Errorf("bulks %v, want %v", c.bulks, want)
+	}
+	if want := []string{"invalid", "conflict"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected %v, want %v", rejected, want)
+	}
+	if st := s.Stats(); st.Delivered != 3 || st.Rejected != 2 || st.Failed != 0 {
+		t.Errorf("stats %+v, want 3 delivered and 2 rejected", st)
+	}
+}
+
+func TestBulkTemporaryFailure(t *testing.T) {
+	c := &cluster{statuses: map[string][]int{
+		"created": {201},
+		"busy":    {503},
+	}}
+	s, stop := newTestClient(c)
+	defer stop()
+	ctx := context.Background()
+	for i, message := range []string{"created", "busy"} {
+		if err := s.Send(ctx, line(message, i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err == nil || retry.IsPermanent(err) {
+		t.Fatalf("flush error %v, want a temporary error", err)
+	}
+	if len(c.bulks) != 3 {
+		t.Errorf("%d bulk requests, want 3", len(c.bulks))
+	}
+	if st := s.Stats(); st.Delivered != 1 || st.Failed != 1 {
+		t.Errorf("stats %+v, want 1 delivered and 1 failed", st)
+	}
+}
+
+func TestDeleteByDate(t *testing.T) {
+	c := &cluster{}
+	s, stop := newTestClient(c)
+	defer stop()
+	ctx := context.Background()
+	from := time.Date(2020, 1, 2, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	if err := s.DeleteByDate(ctx, "App", from, from.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// no index of the app
+	if err := s.DeleteByDate(ctx, "none", from, from.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /_cat/indices/logs-app-*?format=json&h=index",
+		"POST /logs-app-2020.01.01,logs-app-2020.01.02/_delete_by_query?conflicts=proceed&allow_no_indices=true&ignore_unavailable=true",
+		"GET /_cat/indices/logs-none-*?format=json&h=index",
+	}
+	if !reflect.DeepEqual(c.requests, want) {
+		t.Fatalf("requests %v, want %v", c.requests, want)
+	}
+	var query struct {
+		Query struct {
+			Bool struct {
+				Filter []struct {
+					Term  map[string]string `json:"term"`
+					Range struct {
+						Timestamp *struct {
+							GTE string `json:"gte"`
+							LT  string `json:"lt"`
+						} `json:"@timestamp"`
+					} `json:"range"`
+				} `json:"filter"`
+			} `json:"bool"`
+		} `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(c.bodies[1]), &query); err != nil {
+		t.Fatal(err)
+	}
+	filter := query.Query.Bool.Filter
+	if len(filter) != 2 || !reflect.DeepEqual(filter[0].Term, map[string]string{"app": "App"}) || filter[1].Range.Timestamp == nil {
+		t.Fatalf("query %s, want the term of the app and the range", c.bodies[1])
+	}
+	r := filter[1].Range.Timestamp
+	if r.GTE != "2020-01-01T23:00:00Z" || r.LT != "2020-01-02T23:00:00Z" {
+		t.Errorf("range [%s, %s), want the day in UTC", r.GTE, r.LT)
+	}
+}
+
+func TestDropApp(t *testing.T) {
+	c := &cluster{}
+	s, stop := newTestClient(c)
+	defer stop()
+	ctx := context.Background()
+	if err := s.DropApp(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	// no index of the app
+	if err := s.DropApp(ctx, "none"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /_cat/indices/logs-app-*?format=json&h=index",
+		"DELETE /logs-app-2020.01.01,logs-app-2020.01.02?",
+		"GET /_cat/indices/logs-none-*?format=json&h=index",
+	}
+	if !reflect.DeepEqual(c.requests, want) {
+		t.Errorf("requests %v, want %v", c.requests, want)
+	}
+}
@@ -0,0 +1,239 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+)
+
+// Config of the Elasticsearch or OpenSearch cluster.
+type Config struct {
+	URL      string
+	Username string
+	Password string
+	// APIKey is sent instead of the username and password when it is set.
+	APIKey string
+	// IndexPrefix of the daily indices, they are named prefix + app + "-2006.01.02".
+	IndexPrefix string
+}
+
+type Client struct {
+	client *http.Client
+	conf   Config
+}
+
+// bulkItem is the result of a document in the _bulk response.
+type bulkItem struct {
+	Status int `json:"status"`
+	Error  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+func (i bulkItem) err() error {
+	return fmt.Errorf("status %d: %s: %s", i.Status, i.Error.Type, i.Error.Reason)
+}
+
+func NewClient(conf Config) *Client {
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+	return &Client{
+		client: &http.Client{Timeout: 120 * time.Second},
+		conf:   conf,
+	}
+}
+
+// do sends the request and returns the response body.
+// The client errors, except 429 Too Many Requests, are permanent.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, c.conf.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.conf.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.conf.APIKey)
+	} else if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			err = retry.Permanent(err)
+		}
+		return data, resp.StatusCode, err
+	}
+	return data, resp.StatusCode, nil
+}
+
+// bulk sends the documents and returns their results in order.
+func (c *Client) bulk(ctx context.Context, docs []document) ([]bulkItem, error) {
+	var body bytes.Buffer
+	for _, d := range docs {
+		body.Write(d.data)
+	}
+	data, _, err := c.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Items []map[string]bulkItem `json:"items"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("invalid bulk response: %w", err)
+	}
+	if len(resp.Items) != len(docs) {
+		return nil, fmt.Errorf("invalid bulk response: %d items for %d documents", len(resp.Items), len(docs))
+	}
+	items := make([]bulkItem, len(docs))
+	for i, item := range resp.Items {
+		for _, result := range item {
+			items[i] = result
+		}
+	}
+	return items, nil
+}
+
+// putTemplate maps the tags to keyword fields and keeps the type of the float fields of the indices.
+func (c *Client) putTemplate(ctx context.Context) error {
+	name := strings.Trim(c.conf.IndexPrefix, "-_.")
+	if name == "" {
+		name = "logcollector"
+	}
+	template := map[string]interface{}{
+		"index_patterns": []string{c.conf.IndexPrefix + "*"},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{
+						"tags": map[string]interface{}{
+							"path_match": "tags.*",
+							"mapping":    map[string]interface{}{"type": "keyword"},
+						},
+					},
+					map[string]interface{}{
+						"strings": map[string]interface{}{
+							"path_match":         "fields.*",
+							"match_mapping_type": "string",
+							"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+						},
+					},
+					map[string]interface{}{
+						"floats": map[string]interface{}{
+							"path_match":         "fields.*",
+							"match_mapping_type": "double",
+							"mapping":            map[string]interface{}{"type": "double"},
+						},
+					},
+				},
+				"properties": map[string]interface{}{
+					"@timestamp": map[string]interface{}{"type": "date_nanos"},
+					"app":        map[string]interface{}{"type": "keyword"},
+					"message":    map[string]interface{}{"type": "text"},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(ctx, http.MethodPut, "/_index_template/"+url.PathEscape(name), "application/json", body)
+	return err
+}
+
+// indices returns the names of the indices matching the pattern.
+func (c *Client) indices(ctx context.Context, pattern string) ([]string, error) {
+	data, status, err := c.do(ctx, http.MethodGet, "/_cat/indices/"+url.PathEscape(pattern)+"?format=json&h=index", "", nil)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp []struct {
+		Index string `json:"index"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("invalid indices response: %w", err)
+	}
+	var names []string
+	for _, r := range resp {
+		names = append(names, r.Index)
+	}
+	return names, nil
+}
+
+// deleteIndices deletes the indices by name, wildcard deletes can be forbidden.
+func (c *Client) deleteIndices(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	_, _, err := c.do(ctx, http.MethodDelete, "/"+indexList(names), "", nil)
+	return err
+}
+
+// deleteByQuery deletes the documents of the app in [from, to) from the indices.
+func (c *Client) deleteByQuery(ctx context.Context, names []string, app string, from, to time.Time) error {
+	if len(names) == 0 {
+		return nil
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{
+						"term": map[string]interface{}{"app": app},
+					},
+					map[string]interface{}{
+						"range": map[string]interface{}{
+							"@timestamp": map[string]interface{}{
+								"gte": from.UTC().Format(time.RFC3339Nano),
+								"lt":  to.UTC().Format(time.RFC3339Nano),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+	path := "/" + indexList(names) + "/_delete_by_query?conflicts=proceed&allow_no_indices=true&ignore_unavailable=true"
+	_, status, err := c.do(ctx, http.MethodPost, path, "application/json", body)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// indexList returns the escaped names of the indices separated by commas.
+func indexList(names []string) string {
+	escaped := make([]string, len(names))
+	for i, name := range names {
+		escaped[i] = url.PathEscape(name)
+	}
+	return strings.Join(escaped, ",")
+}
@@ -0,0 +1,107 @@
+package elasticsearch
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// indexDate is the layout of the day of the index names.
+const indexDate = "2006.01.02"
+
+// document is the bulk action and the source of a line.
+type document struct {
+	data []byte
+	// id is set when the document has an id, a conflict means it was already written.
+	id bool
+}
+
+type action struct {
+	Create struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id,omitempty"`
+	} `json:"create"`
+}
+
+type source struct {
+	Timestamp string                 `json:"@timestamp"`
+	App       string                 `json:"app"`
+	Message   string                 `json:"message,omitempty"`
+	Tags      map[string]string      `json:"tags,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// document returns the bulk lines of the log line, the raw field is the message.
+// The lines read from a file have an id, so they are not duplicated when they are sent again.
+func (c *batchClient) document(line storage.LogLine) (document, error) {
+	var a action
+	a.Create.Index = c.prefix + strings.ToLower(line.App) + "-" + line.Time.UTC().Format(indexDate)
+	if line.Origin.File != "" && line.Origin.Line > 0 {
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s", line.Origin.Source, line.Origin.File, line.Origin.Line, line.Origin.Raw)))
+		a.Create.ID = hex.EncodeToString(sum[:])
+	}
+	src := source{
+		Timestamp: line.Time.UTC().Format(time.RFC3339Nano),
+		App:       line.App,
+		Tags:      line.Tags,
+		Fields:    make(map[string]interface{}, len(line.Fields)),
+	}
+	for k, v := range line.Fields {
+		if k == "raw" {
+			src.Message, _ = v.(string)
+			continue
+		}
+		switch f := v.(type) {
+		case float64:
+			n, err := float(k, f)
+			if err != nil {
+				return document{}, err
+			}
+			src.Fields[k] = n
+		case float32:
+			n, err := float(k, float64(f))
+			if err != nil {
+				return document{}, err
+			}
+			src.Fields[k] = n
+		default:
+			src.Fields[k] = v
+		}
+	}
+	head, err := json.Marshal(a)
+	if err != nil {
+		return document{}, err
+	}
+	body, err := json.Marshal(src)
+	if err != nil {
+		return document{}, err
+	}
+	d := document{
+		data: make([]byte, 0, len(head)+len(body)+2),
+		id:   a.Create.ID != "",
+	}
+	d.data = append(d.data, head...)
+	d.data = append(d.data, '\n')
+	d.data = append(d.data, body...)
+	d.data = append(d.data, '\n')
+	return d, nil
+}
+
+// float keeps the decimal point of the whole numbers, so the dynamic mapping of the field is double, not long.
+func float(key string, f float64) (json.Number, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("invalid value of field %s: %v", key, f)
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return json.Number(s), nil
+}
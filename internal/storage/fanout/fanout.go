@@ -0,0 +1,370 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+const defaultQueueSize = 1000
+
+var errStopped = errors.New("storage is stopped")
+
+// Route is a storage with the lines it receives.
+type Route struct {
+	Name    string
+	Storage storage.Storage
+	// Apps sent to the storage, all of them when empty.
+	Apps []string
+	// Fields kept in the lines, all of them when empty.
+	Fields []string
+	// QueueSize is the number of lines waiting for the storage, a slow storage does not stall the others
+	// until its queue is full.
+	QueueSize int
+	// Timeout is how long a line waits for the full queue, then it is rejected for this storage.
+	// 0 waits until the context is done.
+	Timeout time.Duration
+}
+
+type fanout struct {
+	storage.Counters
+	routes []*route
+	reject storage.RejectFunc
+	// lock guards stopped, the queues are closed by Stop when no Send or Flush is sending to them.
+	lock    sync.RWMutex
+	stopped bool
+}
+
+type route struct {
+	Route
+	apps   map[string]bool
+	fields map[string]bool
+	queue  chan item
+	done   chan struct{}
+	// ctx of the sends is cancelled when Stop gives up.
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.Mutex
+	// err is the first send error since the previous Flush.
+	err error
+	// undelivered lines were in the queue when Stop gave up.
+	undelivered int64
+}
+
+// item is a line or a flush marker, the marker is closed when the lines before it are sent.
+type item struct {
+	line    storage.LogLine
+	flushed chan struct{}
+}
+
+// New returns the storage sending every line to the routes of its app.
+// Every route has its own queue, a failing or slow storage does not stop the others.
+func New(routes []Route) storage.Storage {
+	f := &fanout{}
+	for _, r := range routes {
+		if r.QueueSize <= 0 {
+			r.QueueSize = defaultQueueSize
+		}
+		rt := &route{
+			Route:  r,
+			apps:   set(r.Apps),
+			fields: set(r.Fields),
+			queue:  make(chan item, r.QueueSize),
+			done:   make(chan struct{}),
+		}
+		rt.ctx, rt.cancel = context.WithCancel(context.Background())
+		f.routes = append(f.routes, rt)
+		go f.run(rt)
+	}
+	return f
+}
+
+func set(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+func (r *route) routes(app string) bool {
+	return r.apps == nil || r.apps[app]
+}
+
+// filter returns a copy of the line with the fields of the route.
+// The maps are copied for every route, the storages of the routes run in parallel and may change their line.
+func (r *route) filter(line storage.LogLine) storage.LogLine {
+	tags := make(map[string]string, len(line.Tags))
+	for k, v := range line.Tags {
+		tags[k] = v
+	}
+	line.Tags = tags
+	fields := make(map[string]interface{}, len(line.Fields))
+	for k, v := range line.Fields {
+		if r.fields == nil || r.fields[k] {
+			fields[k] = v
+		}
+	}
+	line.Fields = fields
+	return line
+}
+
+// run sends the queued lines to the storage of the route.
+func (f *fanout) run(r *route) {
+	defer close(r.done)
+	for it := range r.queue {
+		if it.flushed != nil {
+			close(it.flushed)
+			continue
+		}
+		if err := r.Storage.Send(r.ctx, it.line); err != nil {
+			f.fail(r, it.line, err)
+		}
+	}
+}
+
+// fail records the line the storage of the route did not take.
+// It is rejected unless the route is stopped, then it is only counted as undelivered.
+func (f *fanout) fail(r *route, line storage.LogLine, err error) {
+	err = fmt.Errorf("%s: %w", r.Name, err)
+	r.lock.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	stopped := r.ctx.Err() != nil
+	if stopped {
+		r.undelivered++
+	}
+	r.lock.Unlock()
+	if stopped {
+		f.AddFailed(1)
+		return
+	}
+	f.AddRejected(1)
+	if f.reject != nil {
+		f.reject(line, err)
+	}
+}
+
+// Send queues the line for the routes of its app, it waits for the full queues until their timeout.
+func (f *fanout) Send(ctx context.Context, line storage.LogLine) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.stopped {
+		return errStopped
+	}
+	for _, r := range f.routes {
+		if !r.routes(line.App) {
+			continue
+		}
+		if err := f.enqueue(ctx, r, r.filter(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fanout) enqueue(ctx context.Context, r *route, line storage.LogLine) error {
+	select {
+	case r.queue <- item{line: line}:
+		return nil
+	default:
+	}
+	var timeout <-chan time.Time
+	if r.Timeout > 0 {
+		t := time.NewTimer(r.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case r.queue <- item{line: line}:
+	case <-timeout:
+		f.fail(r, line, errors.New("queue is full"))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// OnReject sets the function called with the lines rejected by any storage, the reason starts with the route name.
+func (f *fanout) OnReject(fn storage.RejectFunc) {
+	f.reject = fn
+	for _, r := range f.routes {
+		rj, ok := r.Storage.(storage.Rejecter)
+		if !ok {
+			continue
+		}
+		name := r.Name
+		rj.OnReject(func(line storage.LogLine, reason error) {
+			fn(line, fmt.Errorf("%s: %w", name, reason))
+		})
+	}
+}
+
+// Flush waits for the queues and flushes the storages, it returns the first error of them,
+// storage.ErrPending only when none of them failed.
+func (f *fanout) Flush(ctx context.Context) error {
+	markers, err := f.mark(ctx)
+	if err != nil {
+		return err
+	}
+	var first error
+	for i, r := range f.routes {
+		select {
+		case <-markers[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := r.Storage.Flush(ctx)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", r.Name, err)
+		}
+		r.lock.Lock()
+		if r.err != nil {
+			err = r.err
+			r.err = nil
+		}
+		r.lock.Unlock()
+		// a write error is returned rather than the pending lines of another storage
+		if first == nil || err != nil && errors.Is(first, storage.ErrPending) {
+			first = err
+		}
+	}
+	return first
+}
+
+// mark queues a flush marker for every route.
+func (f *fanout) mark(ctx context.Context) ([]chan struct{}, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.stopped {
+		return nil, errStopped
+	}
+	markers := make([]chan struct{}, len(f.routes))
+	for i, r := range f.routes {
+		markers[i] = make(chan struct{})
+		select {
+		case r.queue <- item{flushed: markers[i]}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return markers, nil
+}
+
+// Stats returns the sum of the counters of the storages and the lines rejected by the queues.
+func (f *fanout) Stats() storage.Stats {
+	s := f.Counters.Stats()
+	for _, r := range f.routes {
+		rs := r.Storage.Stats()
+		s.Delivered += rs.Delivered
+		s.Rejected += rs.Rejected
+		s.Failed += rs.Failed
+		s.Errors += rs.Errors
+	}
+	return s
+}
+
+// Stop sends the queued lines and stops the storages in parallel until the context is done.
+func (f *fanout) Stop(ctx context.Context) error {
+	f.lock.Lock()
+	if !f.stopped {
+		f.stopped = true
+		for _, r := range f.routes {
+			close(r.queue)
+		}
+	}
+	f.lock.Unlock()
+	errs := make([]error, len(f.routes))
+	wg := sync.WaitGroup{}
+	for i, r := range f.routes {
+		wg.Add(1)
+		go func(i int, r *route) {
+			defer wg.Done()
+			select {
+			case <-r.done:
+			case <-ctx.Done():
+				// the queued lines fail without being sent
+				r.cancel()
+				<-r.done
+			}
+			r.cancel()
+			errs[i] = r.Storage.Stop(ctx)
+		}(i, r)
+	}
+	wg.Wait()
+
+	var entries int64
+	var msgs []string
+	for i, r := range f.routes {
+		if r.undelivered > 0 {
+			entries += r.undelivered
+			msgs = append(msgs, fmt.Sprintf("%s: %d entries in the queue", r.Name, r.undelivered))
+		}
+		if errs[i] == nil {
+			continue
+		}
+		var u *storage.UndeliveredError
+		if errors.As(errs[i], &u) {
+			entries += u.Entries
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %s", r.Name, errs[i]))
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return &storage.UndeliveredError{Entries: entries, Err: errors.New(strings.Join(msgs, "; "))}
+}
+
+// DropDatabase drops the databases of the storages, the storages which can not delete do not stop the others.
+func (f *fanout) DropDatabase(ctx context.Context) error {
+	var unsupported error
+	for _, r := range f.routes {
+		if err := r.Storage.DropDatabase(ctx); errors.Is(err, storage.ErrNotSupported) {
+			unsupported = fmt.Errorf("%s: %w", r.Name, err)
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+	}
+	return unsupported
+}
+
+// DropApp drops the app of the storages it is routed to.
+func (f *fanout) DropApp(ctx context.Context, app string) error {
+	var unsupported error
+	for _, r := range f.routes {
+		if !r.routes(app) {
+			continue
+		}
+		if err := r.Storage.DropApp(ctx, app); errors.Is(err, storage.ErrNotSupported) {
+			unsupported = fmt.Errorf("%s: %w", r.Name, err)
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+	}
+	return unsupported
+}
+
+// DeleteByDate deletes the lines of the range of the storages the app is routed to.
+func (f *fanout) DeleteByDate(ctx context.Context, app string, dateFrom, dateTo time.Time) error {
+	var unsupported error
+	for _, r := range f.routes {
+		if !r.routes(app) {
+			continue
+		}
+		if err := r.Storage.DeleteByDate(ctx, app, dateFrom, dateTo); errors.Is(err, storage.ErrNotSupported) {
+			unsupported = fmt.Errorf("%s: %w", r.Name, err)
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+	}
+	return unsupported
+}
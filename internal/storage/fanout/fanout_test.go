@@ -0,0 +1,222 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// store records the lines it receives, Send blocks while the gate is set.
+type store struct {
+	lock     sync.Mutex
+	name     string
+	lines    []storage.LogLine
+	gate     chan struct{}
+	received chan struct{}
+	flushErr error
+	stopErr  error
+	stats    storage.Stats
+	deleted  error
+}
+
+func (s *store) Send(ctx context.Context, line storage.LogLine) error {
+	if s.received != nil {
+		s.received <- struct{}{}
+	}
+	if s.gate != nil {
+		select {
+		case <-s.gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	// the storages may change their line
+	line.Tags["route"] = s.name
+	delete(line.Fields, "status")
+	s.lock.Lock()
+	s.lines = append(s.lines, line)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *store) Flush(ctx context.Context) error {
+	return s.flushErr
+}
+
+func (s *store) Stats() storage.Stats {
+	return s.stats
+}
+
+func (s *store) Stop(ctx context.Context) error {
+	return s.stopErr
+}
+
+func (s *store) DropApp(ctx context.Context, app string) error {
+	return s.deleted
+}
+
+func (s *store) DeleteByDate(ctx context.Context, app string, dateFrom, dateTo time.Time) error {
+	return s.deleted
+}
+
+func (s *store) DropDatabase(ctx context.Context) error {
+	return s.deleted
+}
+
+func line(app string) storage.LogLine {
+	return storage.LogLine{
+		App:    app,
+		Tags:   map[string]string{"host": "web1"},
+		Fields: map[string]interface{}{"raw": "GET /", "status": int64(200)},
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Origin: storage.Origin{Raw: "GET /"},
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	web := &store{name: "web"}
+	all := &store{name: "all"}
+	f := New([]Route{
+		{Name: "web", Storage: web, Apps: []string{"nginx"}, Fields: []string{"raw"}},
+		{Name: "all", Storage: all},
+	})
+	ctx := context.Background()
+	sent := []storage.LogLine{line("nginx"), line("mysql")}
+	for _, l := range sent {
+		if err := f.Send(ctx, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(web.lines) != 1 || web.lines[0].App != "nginx" {
+		t.Fatalf("lines of the web route %v, want the nginx line", web.lines)
+	}
+	if want := map[string]interface{}{"raw": "GET /"}; !reflect.DeepEqual(web.lines[0].Fields, want) {
+		t.Errorf("fields %v, want %v", web.lines[0].Fields, want)
+	}
+	if len(all.lines) != 2 || all.lines[0].App != "nginx" || all.lines[1].App != "mysql" {
+		t.Fatalf("lines of the all route %v, want both lines", all.lines)
+	}
+	if web.lines[0].Tags["route"] != "web" || all.lines[0].Tags["route"] != "all" {
+		t.Errorf("tags %v and %v, want the tags of every route", web.lines[0].Tags, all.lines[0].Tags)
+	}
+	// the sent lines are not changed by the storages
+	for _, l := range sent {
+		if _, ok := l.Tags["route"]; ok || l.Fields["status"] != int64(200) {
+			t.Errorf("sent line changed: %v %v", l.Tags, l.Fields)
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	slow := &store{name: "slow", gate: make(chan struct{}), received: make(chan struct{}, 10)}
+	fast := &store{name: "fast"}
+	f := New([]Route{
+		{Name: "slow", Storage: slow, QueueSize: 1, Timeout: 10 * time.Millisecond},
+		{Name: "fast", Storage: fast},
+	})
+	var rejected []string
+	f.(storage.Rejecter).OnReject(func(line storage.LogLine, reason error) {
+		rejected = append(rejected, reason.Error())
+	})
+	ctx := context.Background()
+	if err := f.Send(ctx, line("nginx")); err != nil {
+		t.Fatal(err)
+	}
+	// the first line is sent to the slow storage, the second one waits in the queue
+	<-slow.received
+	for i := 0; i < 2; i++ {
+		if err := f.Send(ctx, line("nginx")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(slow.gate)
+	if err := f.Flush(ctx); err == nil || !strings.HasPrefix(err.Error(), "slow: ") {
+		t.Fatalf("flush error %v, want the full queue of the slow route", err)
+	}
+	if err := f.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"slow: queue is full"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected %v, want %v", rejected, want)
+	}
+	if len(slow.lines) != 2 || len(fast.lines) != 3 {
+		t.Errorf("%d slow and %d fast lines, want 2 and 3", len(slow.lines), len(fast.lines))
+	}
+	if st := f.Stats(); st.Rejected != 1 || st.Errors != 1 {
+		t.Errorf("stats %+v, want 1 rejected", st)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	pending := &store{
+		name:     "parquet",
+		flushErr: storage.ErrPending,
+		stats:    storage.Stats{Delivered: 3, Errors: 1, Failed: 1},
+		deleted:  storage.ErrNotSupported,
+	}
+	failing := &store{
+		name:     "loki",
+		flushErr: errors.New("unavailable"),
+		stopErr:  &storage.UndeliveredError{Entries: 2, Err: errors.New("unavailable")},
+		stats:    storage.Stats{Delivered: 1, Rejected: 2, Errors: 2},
+	}
+	f := New([]Route{{Name: "parquet", Storage: pending}, {Name: "loki", Storage: failing}})
+	ctx := context.Background()
+	// a write error is returned rather than the pending lines
+	if err := f.Flush(ctx); err == nil || err.Error() != "loki: unavailable" {
+		t.Errorf("flush error %v, want the loki error", err)
+	}
+	if st, want := f.Stats(), (storage.Stats{Delivered: 4, Rejected: 2, Failed: 1, Errors: 3}); st != want {
+		t.Errorf("stats %+v, want %+v", st, want)
+	}
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := f.DeleteByDate(ctx, "nginx", day, day.AddDate(0, 0, 1)); !errors.Is(err, storage.ErrNotSupported) || !strings.HasPrefix(err.Error(), "parquet: ") {
+		t.Errorf("delete error %v, want the unsupported parquet delete", err)
+	}
+	failing.deleted = errors.New("timeout")
+	if err := f.DropApp(ctx, "nginx"); err == nil || err.Error() != "loki: timeout" {
+		t.Errorf("drop error %v, want the loki error", err)
+	}
+	err := f.Stop(ctx)
+	var u *storage.UndeliveredError
+	if !errors.As(err, &u) || u.Entries != 2 || !strings.Contains(err.Error(), "loki: 2 entries not delivered") {
+		t.Errorf("stop error %v, want the undelivered loki entries", err)
+	}
+}
+
+func TestSendAfterStop(t *testing.T) {
+	f := New([]Route{{Name: "all", Storage: &store{name: "all"}, QueueSize: 1}})
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the lines sent while stopping are queued or refused, the flushes too
+			for f.Send(ctx, line("nginx")) == nil && f.Flush(ctx) == nil {
+			}
+		}()
+	}
+	if err := f.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := f.Send(ctx, line("nginx")); err != errStopped {
+		t.Fatalf("send error %v, want the stopped storage", err)
+	}
+	if err := f.Flush(ctx); err != errStopped {
+		t.Fatalf("flush error %v, want the stopped storage", err)
+	}
+	if err := f.Stop(ctx); err != nil {
+		t.Fatalf("second stop error %v", err)
+	}
+}
@@ -0,0 +1,427 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// The keys of the lines which are not a tag or a field, the tags and fields named like them get a tag_ or field_ prefix.
+const (
+	timeKey = "time"
+	appKey  = "app"
+	rawKey  = "raw"
+)
+
+// Config of the files.
+type Config struct {
+	// Dir of the files, they are named Dir/app/2006-01-02.N.format with the extension of the compression.
+	// The days are local like the days of the collect command.
+	Dir string
+	// Format is ndjson, logfmt or parquet.
+	Format string
+	// Compression is gzip, zstd or none, the pages of the parquet files are compressed and snappy can be used too.
+	Compression string
+	// MaxSize of the uncompressed content of a file, 0 means no limit.
+	MaxSize int64
+	// MaxAge of a file, 0 means no limit.
+	MaxAge time.Duration
+}
+
+// writer writes the lines of a file.
+type writer interface {
+	write(line storage.LogLine) error
+	// written returns the size of the content.
+	written() int64
+	flush() error
+	close() error
+}
+
+// file is an open file of an app and a day.
+type file struct {
+	app    string
+	day    string
+	path   string
+	w      writer
+	opened time.Time
+	// lines are not flushed yet.
+	lines int
+	// active is set when a line was written since the previous Flush.
+	active bool
+}
+
+type store struct {
+	storage.Counters
+	conf Config
+	log  xlog.Logger
+	ext  string
+	lock sync.Mutex
+	// files are the open files by app and day.
+	files   map[string]*file
+	stopped bool
+	// err is the first write error since the previous Flush.
+	err         error
+	lastErr     error
+	undelivered int64
+}
+
+// New returns the storage writing a file per app and day, a new file is started when the file reaches the MaxSize or the MaxAge.
+// The files not written since the previous Flush are closed. The parquet files are written when they are closed,
+// Flush returns storage.ErrPending until then.
+func New(log xlog.Logger, conf Config) (storage.Storage, error) {
+	s := &store{
+		conf:  conf,
+		log:   log,
+		ext:   "." + conf.Format,
+		files: make(map[string]*file),
+	}
+	switch conf.Format {
+	case "ndjson", "logfmt":
+		switch conf.Compression {
+		case "gzip":
+			s.ext += ".gz"
+		case "zstd":
+			s.ext += ".zst"
+		case "", "none":
+		default:
+			return nil, fmt.Errorf("unknown compression of %s files: %s", conf.Format, conf.Compression)
+		}
+	case "parquet":
+		if _, err := parquetCodec(conf.Compression); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown file format: %s", conf.Format)
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parquetCodec(compression string) (int32, error) {
+	switch compression {
+	case "snappy":
+		return codecSnappy, nil
+	case "gzip":
+		return codecGzip, nil
+	case "zstd":
+		return codecZstd, nil
+	case "", "none":
+		return codecUncompressed, nil
+	}
+	return 0, fmt.Errorf("unknown compression of parquet files: %s", compression)
+}
+
+// Send writes the line, the lines which can not be encoded or written are refused.
+func (s *store) Send(ctx context.Context, line storage.LogLine) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return errors.New("storage is stopped")
+	}
+	day := line.Time.Local().Format("2006-01-02")
+	key := line.App + "/" + day
+	f, ok := s.files[key]
+	if ok && s.full(f) {
+		s.close(key, f)
+		ok = false
+	}
+	if !ok {
+		var err error
+		if f, err = s.open(line.App, day); err != nil {
+			return err
+		}
+		s.files[key] = f
+	}
+	if err := f.w.write(line); err != nil {
+		return fmt.Errorf("unable to write %s: %w", f.path, err)
+	}
+	f.lines++
+	f.active = true
+	return nil
+}
+
+// full reports whether a new file should be started.
+func (s *store) full(f *file) bool {
+	return s.conf.MaxSize > 0 && f.w.written() >= s.conf.MaxSize ||
+		s.conf.MaxAge > 0 && time.Since(f.opened) >= s.conf.MaxAge
+}
+
+// open creates the next file of the app and the day, the existing files are kept.
+func (s *store) open(app, day string) (*file, error) {
+	dir := filepath.Join(s.conf.Dir, dirName(app))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	n := 1
+	for _, name := range s.names(dir) {
+		parts := strings.SplitN(name, ".", 3)
+		if parts[0] != day {
+			continue
+		}
+		if i, err := strconv.Atoi(parts[1]); err == nil && i >= n {
+			n = i + 1
+		}
+	}
+	f := &file{
+		app:    app,
+		day:    day,
+		path:   filepath.Join(dir, day+"."+strconv.Itoa(n)+s.ext),
+		opened: time.Now(),
+	}
+	s.log.Debugf("Open file: %s", f.path)
+	var err error
+	switch s.conf.Format {
+	case "ndjson":
+		f.w, err = newStreamWriter(f.path, s.conf.Compression, encodeNDJSON)
+	case "logfmt":
+		f.w, err = newStreamWriter(f.path, s.conf.Compression, encodeLogfmt)
+	case "parquet":
+		codec, _ := parquetCodec(s.conf.Compression)
+		f.w = newParquetWriter(f.path, codec)
+	}
+	return f, err
+}
+
+// names returns the names of the files of the format in the dir of an app, the temporary parquet files too.
+func (s *store) names(dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, s.ext) || strings.HasSuffix(name, s.ext+".tmp") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// dirName returns the name of the dir of the app, the path separators are replaced.
+func dirName(app string) string {
+	name := strings.NewReplacer("/", "_", `\`, "_").Replace(app)
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
+
+// close closes the file, its lines are delivered or failed.
+func (s *store) close(key string, f *file) {
+	delete(s.files, key)
+	s.log.Debugf("Close file: %s", f.path)
+	s.done(f, f.w.close())
+}
+
+// done counts the lines of the file after a flush or a close.
+func (s *store) done(f *file, err error) {
+	if err == nil {
+		s.AddDelivered(f.lines)
+		f.lines = 0
+		return
+	}
+	err = fmt.Errorf("unable to write %s: %w", f.path, err)
+	s.log.Error(err)
+	s.lastErr = err
+	if s.err == nil {
+		s.err = err
+	}
+	if f.lines > 0 {
+		s.AddFailed(f.lines)
+		s.undelivered += int64(f.lines)
+		f.lines = 0
+	}
+}
+
+// Flush writes the buffered lines and closes the files which were not written since the previous Flush or are too old.
+// It returns the first write error since the previous Flush, or storage.ErrPending while a parquet file is open with lines.
+func (s *store) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return errors.New("storage is stopped")
+	}
+	pending := false
+	for _, key := range s.keys() {
+		f := s.files[key]
+		if !f.active || s.full(f) {
+			s.close(key, f)
+			continue
+		}
+		f.active = false
+		// the lines of the parquet files are delivered when the file is closed
+		if err := f.w.flush(); err != nil || s.conf.Format != "parquet" {
+			s.done(f, err)
+		}
+		pending = pending || f.lines > 0
+	}
+	err := s.err
+	s.err = nil
+	if err == nil && pending {
+		return storage.ErrPending
+	}
+	return err
+}
+
+// keys returns the keys of the open files in order.
+func (s *store) keys() []string {
+	keys := make([]string, 0, len(s.files))
+	for key := range s.files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Stop closes the files.
+func (s *store) Stop(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		for _, key := range s.keys() {
+			s.close(key, s.files[key])
+		}
+	}
+	if s.undelivered > 0 {
+		return &storage.UndeliveredError{Entries: s.undelivered, Err: s.lastErr}
+	}
+	return nil
+}
+
+// remove closes the open files of the app matching the day and removes them with the other files of the format.
+// The day is empty for every day.
+func (s *store) remove(app, day string) error {
+	for _, key := range s.keys() {
+		if f := s.files[key]; dirName(f.app) == dirName(app) && (day == "" || f.day == day) {
+			s.close(key, f)
+		}
+	}
+	dir := filepath.Join(s.conf.Dir, dirName(app))
+	for _, name := range s.names(dir) {
+		if day != "" && !strings.HasPrefix(name, day+".") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	// the dir is kept when it has other files
+	os.Remove(dir)
+	return nil
+}
+
+func (s *store) DropDatabase(ctx context.Context) error {
+	s.log.Debugf("Remove the %s files of: %s", s.conf.Format, s.conf.Dir)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	infos, err := ioutil.ReadDir(s.conf.Dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if err := s.remove(info.Name(), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) DropApp(ctx context.Context, app string) error {
+	s.log.Debugf("Remove the %s files of: %s", s.conf.Format, app)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(app, "")
+}
+
+// DeleteByDate removes the files of the local days of the range.
+func (s *store) DeleteByDate(ctx context.Context, app string, dateFrom, dateTo time.Time) error {
+	s.log.Debugf("Delete by date: %s %s->%s", app, dateFrom, dateTo)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	from := dateFrom.Local()
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local); day.Before(dateTo); day = day.AddDate(0, 0, 1) {
+		if err := s.remove(app, day.Format("2006-01-02")); err != nil {
+			s.log.Error("Unable to delete by date", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// keyval is a tag or a field of a line with the name it is written under.
+type keyval struct {
+	key   string
+	value interface{}
+}
+
+// keyvals returns the tags then the fields sorted by key, the numbers are int64 or float64.
+// The raw field is left out, the tags named like a fixed key and the fields named like a tag or a fixed key get a prefix.
+func keyvals(line storage.LogLine) []keyval {
+	kvs := make([]keyval, 0, len(line.Tags)+len(line.Fields))
+	for _, k := range sortedKeys(line.Tags) {
+		name := k
+		switch k {
+		case timeKey, appKey, rawKey:
+			name = "tag_" + k
+		}
+		kvs = append(kvs, keyval{key: name, value: line.Tags[k]})
+	}
+	keys := make([]string, 0, len(line.Fields))
+	for k := range line.Fields {
+		if k != rawKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := k
+		if _, ok := line.Tags[k]; ok || k == timeKey || k == appKey {
+			name = "field_" + k
+		}
+		kvs = append(kvs, keyval{key: name, value: normalize(line.Fields[k])})
+	}
+	return kvs
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// normalize converts the numbers to int64 and float64.
+func normalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
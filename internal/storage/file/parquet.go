@@ -0,0 +1,529 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// The parquet types, encodings and codecs of the format.
+const (
+	typeBoolean   = 0
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	codecSnappy       = 1
+	codecGzip         = 2
+	codecZstd         = 6
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	convertedUTF8 = 0
+
+	pageData = 0
+)
+
+// The thrift compact protocol types.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+var parquetMagic = []byte("PAR1")
+
+// pageRows is the number of rows of a data page.
+const pageRows = 64 * 1024
+
+// parquetWriter keeps the rows in memory, the file is written when it is closed with a row group.
+// The columns are the union of the tags and fields of the rows, the type of a column is widened when a value does not fit:
+// an int64 column becomes a double column and the other conflicts become a string column.
+type parquetWriter struct {
+	path    string
+	codec   int32
+	rows    int
+	size    int64
+	columns map[string]*column
+}
+
+type column struct {
+	name     string
+	kind     int32
+	required bool
+	// present is set for the rows having a value, the values of the other rows are null.
+	present []bool
+	ints    []int64
+	floats  []float64
+	bools   []bool
+	strings []string
+}
+
+func newParquetWriter(path string, codec int32) *parquetWriter {
+	w := &parquetWriter{
+		path:    path,
+		codec:   codec,
+		columns: make(map[string]*column),
+	}
+	w.columns[timeKey] = &column{name: timeKey, kind: typeInt64, required: true}
+	w.columns[appKey] = &column{name: appKey, kind: typeByteArray, required: true}
+	return w
+}
+
+func (w *parquetWriter) write(line storage.LogLine) error {
+	w.columns[timeKey].add(w.rows, line.Time.UnixNano())
+	w.columns[appKey].add(w.rows, line.App)
+	for _, kv := range keyvals(line) {
+		c, ok := w.columns[kv.key]
+		if !ok {
+			c = &column{name: kv.key, kind: kindOf(kv.value)}
+			w.columns[kv.key] = c
+		}
+		c.add(w.rows, kv.value)
+	}
+	if raw, ok := line.Fields[rawKey]; ok {
+		c, ok := w.columns[rawKey]
+		if !ok {
+			c = &column{name: rawKey, kind: typeByteArray}
+			w.columns[rawKey] = c
+		}
+		c.add(w.rows, fmt.Sprint(raw))
+	}
+	w.rows++
+	w.size += int64(line.Size)
+	return nil
+}
+
+func (w *parquetWriter) written() int64 {
+	return w.size
+}
+
+// flush does nothing, a parquet file can be read only when its footer is written.
+func (w *parquetWriter) flush() error {
+	return nil
+}
+
+// close writes the file, it is renamed when it is complete.
+func (w *parquetWriter) close() error {
+	tmp := w.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(f, 1<<20)
+	err = w.writeTo(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
+
+func (w *parquetWriter) writeTo(out *bufio.Writer) error {
+	names := make([]string, 0, len(w.columns))
+	for name := range w.columns {
+		if name != timeKey && name != appKey && name != rawKey {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{timeKey, appKey}, names...)
+	if _, ok := w.columns[rawKey]; ok {
+		names = append(names, rawKey)
+	}
+
+	if _, err := out.Write(parquetMagic); err != nil {
+		return err
+	}
+	offset := int64(len(parquetMagic))
+	var chunks [][]byte
+	var total int64
+	schema := [][]byte{new(thrift).str(4, "schema").i32(5, int32(len(names))).end()}
+	for _, name := range names {
+		c := w.columns[name]
+		c.fill(w.rows)
+		schema = append(schema, c.schema())
+		start := offset
+		var uncompressed, compressed int64
+		for from := 0; from < w.rows; from += pageRows {
+			to := from + pageRows
+			if to > w.rows {
+				to = w.rows
+			}
+			page := c.page(from, to)
+			data, err := compress(w.codec, page)
+			if err != nil {
+				return err
+			}
+			header := new(thrift).
+				i32(1, pageData).
+				i32(2, int32(len(page))).
+				i32(3, int32(len(data))).
+				strct(5, new(thrift).
+					i32(1, int32(to-from)).
+					i32(2, encodingPlain).
+					i32(3, encodingRLE).
+					i32(4, encodingRLE).
+					end()).
+				end()
+			if _, err := out.Write(header); err != nil {
+				return err
+			}
+			if _, err := out.Write(data); err != nil {
+				return err
+			}
+			uncompressed += int64(len(header) + len(page))
+			compressed += int64(len(header) + len(data))
+			offset += int64(len(header) + len(data))
+		}
+		meta := new(thrift).
+			i32(1, c.kind).
+			list(2, thriftI32, [][]byte{varint(nil, zigzag(encodingPlain)), varint(nil, zigzag(encodingRLE))}).
+			list(3, thriftBinary, [][]byte{binaryValue(name)}).
+			i32(4, w.codec).
+			i64(5, int64(w.rows)).
+			i64(6, uncompressed).
+			i64(7, compressed).
+			i64(9, start).
+			end()
+		chunks = append(chunks, new(thrift).i64(2, start).strct(3, meta).end())
+		total += uncompressed
+	}
+	rowGroup := new(thrift).
+		list(1, thriftStruct, chunks).
+		i64(2, total).
+		i64(3, int64(w.rows)).
+		end()
+	footer := new(thrift).
+		i32(1, 1).
+		list(2, thriftStruct, schema).
+		i64(3, int64(w.rows)).
+		list(4, thriftStruct, [][]byte{rowGroup}).
+		str(6, "logcollector").
+		end()
+	if _, err := out.Write(footer); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(footer)))
+	if _, err := out.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := out.Write(parquetMagic)
+	return err
+}
+
+func compress(codec int32, data []byte) ([]byte, error) {
+	switch codec {
+	case codecSnappy:
+		return snappy.Encode(nil, data), nil
+	case codecGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case codecZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+	}
+	return data, nil
+}
+
+// kindOf returns the parquet type of the normalized value.
+func kindOf(v interface{}) int32 {
+	switch v.(type) {
+	case int64:
+		return typeInt64
+	case float64:
+		return typeDouble
+	case bool:
+		return typeBoolean
+	}
+	return typeByteArray
+}
+
+// add sets the value of the row, the column is widened when the value does not fit in it.
+func (c *column) add(row int, v interface{}) {
+	c.fill(row)
+	kind := kindOf(v)
+	if kind != c.kind {
+		switch {
+		case c.kind == typeInt64 && kind == typeDouble:
+			c.widen(typeDouble)
+		case c.kind == typeDouble && kind == typeInt64:
+			v = float64(v.(int64))
+		case c.kind != typeByteArray:
+			c.widen(typeByteArray)
+		}
+	}
+	switch c.kind {
+	case typeInt64:
+		c.ints = append(c.ints, v.(int64))
+	case typeDouble:
+		c.floats = append(c.floats, v.(float64))
+	case typeBoolean:
+		c.bools = append(c.bools, v.(bool))
+	default:
+		c.strings = append(c.strings, format(v))
+	}
+	c.present = append(c.present, true)
+}
+
+// fill sets the missing values of the rows before row to null.
+func (c *column) fill(row int) {
+	for len(c.present) < row {
+		c.present = append(c.present, false)
+	}
+}
+
+// widen converts the values to the kind, it is double for an int64 column, otherwise string.
+func (c *column) widen(kind int32) {
+	if kind == typeDouble {
+		for _, n := range c.ints {
+			c.floats = append(c.floats, float64(n))
+		}
+	} else {
+		for _, n := range c.ints {
+			c.strings = append(c.strings, format(n))
+		}
+		for _, f := range c.floats {
+			c.strings = append(c.strings, format(f))
+		}
+		for _, b := range c.bools {
+			c.strings = append(c.strings, format(b))
+		}
+		c.floats = nil
+	}
+	c.ints = nil
+	c.bools = nil
+	c.kind = kind
+}
+
+func format(v interface{}) string {
+	switch n := v.(type) {
+	case string:
+		return n
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case float64:
+		return strconv.FormatFloat(n, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(n)
+	}
+	return fmt.Sprint(v)
+}
+
+// schema returns the SchemaElement of the column, the time is a timestamp in nanoseconds.
+func (c *column) schema() []byte {
+	t := new(thrift).i32(1, c.kind)
+	if c.required {
+		t.i32(3, repetitionRequired)
+	} else {
+		t.i32(3, repetitionOptional)
+	}
+	t.str(4, c.name)
+	switch {
+	case c.name == timeKey:
+		unit := new(thrift).strct(3, new(thrift).end()).end()
+		t.strct(10, new(thrift).strct(8, new(thrift).boolean(1, true).strct(2, unit).end()).end())
+	case c.kind == typeByteArray:
+		t.i32(6, convertedUTF8)
+		t.strct(10, new(thrift).strct(1, new(thrift).end()).end())
+	}
+	return t.end()
+}
+
+// page returns the content of the data page of the rows, the definition levels and the plain values.
+func (c *column) page(from, to int) []byte {
+	var b []byte
+	if !c.required {
+		levels := definitionLevels(c.present[from:to])
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(levels)))
+		b = append(b, size[:]...)
+		b = append(b, levels...)
+	}
+	// the values of the rows before from
+	first := 0
+	for _, p := range c.present[:from] {
+		if p {
+			first++
+		}
+	}
+	n := 0
+	for _, p := range c.present[from:to] {
+		if p {
+			n++
+		}
+	}
+	switch c.kind {
+	case typeInt64:
+		for _, v := range c.ints[first : first+n] {
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], uint64(v))
+			b = append(b, buf[:]...)
+		}
+	case typeDouble:
+		for _, v := range c.floats[first : first+n] {
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+			b = append(b, buf[:]...)
+		}
+	case typeBoolean:
+		packed := make([]byte, (n+7)/8)
+		for i, v := range c.bools[first : first+n] {
+			if v {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		b = append(b, packed...)
+	default:
+		for _, v := range c.strings[first : first+n] {
+			var size [4]byte
+			binary.LittleEndian.PutUint32(size[:], uint32(len(v)))
+			b = append(b, size[:]...)
+			b = append(b, v...)
+		}
+	}
+	return b
+}
+
+// definitionLevels returns the levels of the rows with the RLE encoding, 1 is a value and 0 is null.
+func definitionLevels(present []bool) []byte {
+	var b []byte
+	for i := 0; i < len(present); {
+		j := i + 1
+		for j < len(present) && present[j] == present[i] {
+			j++
+		}
+		b = varint(b, uint64(j-i)<<1)
+		if present[i] {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		i = j
+	}
+	return b
+}
+
+func varint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func binaryValue(s string) []byte {
+	return append(varint(nil, uint64(len(s))), s...)
+}
+
+// thrift writes a struct with the compact protocol of thrift, the format of the parquet metadata.
+type thrift struct {
+	b    []byte
+	last int
+}
+
+func (t *thrift) field(id int, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.b = append(t.b, byte(delta<<4)|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = varint(t.b, zigzag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thrift) i32(id int, v int32) *thrift {
+	t.field(id, thriftI32)
+	t.b = varint(t.b, zigzag(int64(v)))
+	return t
+}
+
+func (t *thrift) i64(id int, v int64) *thrift {
+	t.field(id, thriftI64)
+	t.b = varint(t.b, zigzag(v))
+	return t
+}
+
+func (t *thrift) str(id int, s string) *thrift {
+	t.field(id, thriftBinary)
+	t.b = append(t.b, binaryValue(s)...)
+	return t
+}
+
+func (t *thrift) boolean(id int, v bool) *thrift {
+	if v {
+		t.field(id, thriftTrue)
+	} else {
+		t.field(id, thriftFalse)
+	}
+	return t
+}
+
+// strct writes the struct ended by end.
+func (t *thrift) strct(id int, data []byte) *thrift {
+	t.field(id, thriftStruct)
+	t.b = append(t.b, data...)
+	return t
+}
+
+// list writes the encoded elements of the type.
+func (t *thrift) list(id int, typ byte, elems [][]byte) *thrift {
+	t.field(id, thriftList)
+	if len(elems) < 15 {
+		t.b = append(t.b, byte(len(elems)<<4)|typ)
+	} else {
+		t.b = append(t.b, 0xf0|typ)
+		t.b = varint(t.b, uint64(len(elems)))
+	}
+	for _, e := range elems {
+		t.b = append(t.b, e...)
+	}
+	return t
+}
+
+// end returns the struct with its stop field.
+func (t *thrift) end() []byte {
+	return append(t.b, 0)
+}
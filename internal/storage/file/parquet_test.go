@@ -0,0 +1,346 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// readThrift decodes a struct of the thrift compact protocol, it returns the fields by id and the size of the struct.
+// The integers are int64, the binaries []byte, the structs map[int]interface{} and the lists []interface{}.
+func readThrift(t *testing.T, b []byte) (map[int]interface{}, int) {
+	t.Helper()
+	fields := make(map[int]interface{})
+	pos, last := 0, 0
+	for {
+		head := b[pos]
+		pos++
+		if head == 0 {
+			return fields, pos
+		}
+		typ := head & 0x0f
+		id := last + int(head>>4)
+		if head>>4 == 0 {
+			v, n := binary.Uvarint(b[pos:])
+			id = int(unzigzag(v))
+			pos += n
+		}
+		last = id
+		var n int
+		fields[id], n = readThriftValue(t, typ, b[pos:])
+		pos += n
+	}
+}
+
+func readThriftValue(t *testing.T, typ byte, b []byte) (interface{}, int) {
+	switch typ {
+	case thriftTrue:
+		return true, 0
+	case thriftFalse:
+		return false, 0
+	case thriftI32, thriftI64:
+		v, n := binary.Uvarint(b)
+		return unzigzag(v), n
+	case thriftBinary:
+		l, n := binary.Uvarint(b)
+		return b[n : n+int(l)], n + int(l)
+	case thriftStruct:
+		return readThrift(t, b)
+	case thriftList:
+		size, typ, pos := int(b[0]>>4), b[0]&0x0f, 1
+		if size == 15 {
+			l, n := binary.Uvarint(b[1:])
+			size = int(l)
+			pos += n
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			var n int
+			if typ == thriftStruct {
+				list[i], n = readThrift(t, b[pos:])
+			} else {
+				list[i], n = readThriftValue(t, typ, b[pos:])
+			}
+			pos += n
+		}
+		return list, pos
+	}
+	t.Fatalf("unknown thrift type %d", typ)
+	return nil, 0
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// readParquet reads the rows of the file written by the parquetWriter, the null values are left out of the rows.
+func readParquet(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, parquetMagic) || !bytes.HasSuffix(data, parquetMagic) {
+		t.Fatal("missing magic")
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta, n := readThrift(t, data[len(data)-8-size:len(data)-8])
+	if n != size {
+		t.Fatalf("footer of %d bytes, read %d", size, n)
+	}
+	numRows := int(meta[3].(int64))
+	rows := make([]map[string]interface{}, numRows)
+	for i := range rows {
+		rows[i] = make(map[string]interface{})
+	}
+	schema := meta[2].([]interface{})
+	if children := schema[0].(map[int]interface{})[5].(int64); int(children) != len(schema)-1 {
+		t.Fatalf("schema root with %d children for %d columns", children, len(schema)-1)
+	}
+	groups := meta[4].([]interface{})
+	if len(groups) != 1 {
+		t.Fatalf("%d row groups, want 1", len(groups))
+	}
+	chunks := groups[0].(map[int]interface{})[1].([]interface{})
+	for i, chunk := range chunks {
+		element := schema[i+1].(map[int]interface{})
+		name := string(element[4].([]byte))
+		optional := element[3].(int64) == repetitionOptional
+		cm := chunk.(map[int]interface{})[3].(map[int]interface{})
+		if path := string(cm[3].([]interface{})[0].([]byte)); path != name {
+			t.Fatalf("column chunk %s of schema element %s", path, name)
+		}
+		kind := cm[1].(int64)
+		codec := int32(cm[4].(int64))
+		offset := int(cm[9].(int64))
+		end := offset + int(cm[7].(int64))
+		row := 0
+		for offset < end {
+			header, n := readThrift(t, data[offset:])
+			offset += n
+			page := data[offset : offset+int(header[3].(int64))]
+			offset += len(page)
+			page = decompress(t, codec, page)
+			if len(page) != int(header[2].(int64)) {
+				t.Fatalf("page of %d bytes, want %d", len(page), header[2])
+			}
+			values := int(header[5].(map[int]interface{})[1].(int64))
+			present := make([]bool, values)
+			for j := range present {
+				present[j] = true
+			}
+			if optional {
+				l := int(binary.LittleEndian.Uint32(page))
+				present = readLevels(t, page[4:4+l], values)
+				page = page[4+l:]
+			}
+			for j, p := range present {
+				if !p {
+					continue
+				}
+				var v interface{}
+				switch kind {
+				case typeInt64:
+					v = int64(binary.LittleEndian.Uint64(page))
+					page = page[8:]
+				case typeDouble:
+					v = math.Float64frombits(binary.LittleEndian.Uint64(page))
+					page = page[8:]
+				case typeBoolean:
+					// the values of the page are packed from the first bit
+					k := 0
+					for _, q := range present[:j] {
+						if q {
+							k++
+						}
+					}
+					v = page[k/8]&(1<<uint(k%8)) != 0
+				default:
+					l := int(binary.LittleEndian.Uint32(page))
+					v = string(page[4 : 4+l])
+					page = page[4+l:]
+				}
+				rows[row+j][name] = v
+			}
+			row += values
+		}
+		if row != numRows {
+			t.Fatalf("column %s has %d rows, want %d", name, row, numRows)
+		}
+	}
+	return rows
+}
+
+// readLevels decodes the RLE runs of the definition levels.
+func readLevels(t *testing.T, b []byte, values int) []bool {
+	var present []bool
+	for len(b) > 0 {
+		head, n := binary.Uvarint(b)
+		if head&1 != 0 {
+			t.Fatal("bit-packed definition levels")
+		}
+		for i := 0; i < int(head>>1); i++ {
+			present = append(present, b[n] == 1)
+		}
+		b = b[n+1:]
+	}
+	if len(present) != values {
+		t.Fatalf("%d definition levels, want %d", len(present), values)
+	}
+	return present
+}
+
+func decompress(t *testing.T, codec int32, data []byte) []byte {
+	var out []byte
+	var err error
+	switch codec {
+	case codecSnappy:
+		out, err = snappy.Decode(nil, data)
+	case codecGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			out, err = ioutil.ReadAll(r)
+		}
+	case codecZstd:
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(nil); err == nil {
+			out, err = d.DecodeAll(data, nil)
+			d.Close()
+		}
+	default:
+		out = data
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// parquetLines are the lines of the tests, now is the time of the first line.
+func parquetLines(now time.Time) []storage.LogLine {
+	return []storage.LogLine{
+		{
+			App:    "app",
+			Tags:   map[string]string{"host": "web1", "time": "tag"},
+			Fields: map[string]interface{}{"raw": "first", "status": 200, "took": int64(1), "ok": true},
+			Time:   now,
+		},
+		{
+			// the took column is widened to double, the status column to string
+			App:    "app",
+			Tags:   map[string]string{"host": "web2"},
+			Fields: map[string]interface{}{"status": "unknown", "took": 0.5, "ok": false, "host": "field"},
+			Time:   now.Add(time.Second),
+		},
+		{
+			App:    "app",
+			Fields: map[string]interface{}{"raw": "third", "ok": true},
+			Time:   now.Add(2 * time.Second),
+		},
+	}
+}
+
+func writeParquet(t *testing.T, path string, codec int32, lines []storage.LogLine) {
+	t.Helper()
+	w := newParquetWriter(path, codec)
+	for _, line := range lines {
+		if err := w.write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	want := []map[string]interface{}{
+		{"time": now.UnixNano(), "app": "app", "host": "web1", "tag_time": "tag", "status": "200", "took": 1.0, "ok": true, "raw": "first"},
+		{"time": now.Add(time.Second).UnixNano(), "app": "app", "host": "web2", "status": "unknown", "took": 0.5, "ok": false, "field_host": "field"},
+		{"time": now.Add(2 * time.Second).UnixNano(), "app": "app", "ok": true, "raw": "third"},
+	}
+	for _, codec := range []string{"none", "snappy", "gzip", "zstd"} {
+		c, _ := parquetCodec(codec)
+		path := filepath.Join(dir, codec+".parquet")
+		writeParquet(t, path, c, parquetLines(now))
+		if got := readParquet(t, path); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: rows\n%v\nwant\n%v", codec, got, want)
+		}
+	}
+}
+
+// TestParquetFixture compares the file with testdata/lines.parquet, its schema and rows were checked with the readers of
+// github.com/xitongsys/parquet-go. A fixture written by a changed writer has to be checked again with a parquet reader.
+func TestParquetFixture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lines.parquet")
+	writeParquet(t, path, codecUncompressed, parquetLines(time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)))
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "lines.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("file of %d bytes differs from the fixture of %d bytes", len(got), len(want))
+	}
+}
+
+func TestParquetPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pages.parquet")
+	w := newParquetWriter(path, codecSnappy)
+	now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	rows := pageRows + 10
+	for i := 0; i < rows; i++ {
+		fields := map[string]interface{}{}
+		// the values of the second page start in the middle of the values
+		if i%3 == 0 {
+			fields["n"] = int64(i)
+		}
+		if err := w.write(storage.LogLine{App: "app", Fields: fields, Time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readParquet(t, path)
+	if len(got) != rows {
+		t.Fatalf("%d rows, want %d", len(got), rows)
+	}
+	for i, row := range got {
+		n, ok := row["n"]
+		if ok != (i%3 == 0) || ok && n != int64(i) {
+			t.Fatalf("row %d: n %v, want %d", i, n, i)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-logfmt/logfmt"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// compressor is the compressed writer of a file, Flush makes the written content readable.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// nopCompressor writes the content as it is.
+type nopCompressor struct {
+	io.Writer
+}
+
+func (nopCompressor) Flush() error { return nil }
+func (nopCompressor) Close() error { return nil }
+
+// streamWriter writes a line of text per log line.
+type streamWriter struct {
+	f      *os.File
+	comp   compressor
+	buf    *bufio.Writer
+	encode func(*bytes.Buffer, storage.LogLine) error
+	line   bytes.Buffer
+	size   int64
+}
+
+func newStreamWriter(path string, compression string, encode func(*bytes.Buffer, storage.LogLine) error) (*streamWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &streamWriter{
+		f:      f,
+		encode: encode,
+	}
+	switch compression {
+	case "gzip":
+		w.comp = gzip.NewWriter(f)
+	case "zstd":
+		enc, err := zstd.NewWriter(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		w.comp = enc
+	default:
+		w.comp = nopCompressor{f}
+	}
+	w.buf = bufio.NewWriterSize(w.comp, 256*1024)
+	return w, nil
+}
+
+// write encodes the line first, so a line which can not be encoded is not written partially.
+func (w *streamWriter) write(line storage.LogLine) error {
+	w.line.Reset()
+	if err := w.encode(&w.line, line); err != nil {
+		return err
+	}
+	n, err := w.buf.Write(w.line.Bytes())
+	w.size += int64(n)
+	return err
+}
+
+func (w *streamWriter) written() int64 {
+	return w.size
+}
+
+func (w *streamWriter) flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.comp.Flush()
+}
+
+func (w *streamWriter) close() error {
+	err := w.buf.Flush()
+	if closeErr := w.comp.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type record struct {
+	Time   time.Time              `json:"time"`
+	App    string                 `json:"app"`
+	Tags   map[string]string      `json:"tags,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// encodeNDJSON writes the line as a JSON object, the map keys are sorted so the files can be compared.
+func encodeNDJSON(b *bytes.Buffer, line storage.LogLine) error {
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(record{
+		Time:   line.Time.UTC(),
+		App:    line.App,
+		Tags:   line.Tags,
+		Fields: line.Fields,
+	})
+}
+
+// encodeLogfmt writes the line normalized: the time in UTC and the app, the tags and the fields sorted by key, then the raw field.
+func encodeLogfmt(b *bytes.Buffer, line storage.LogLine) error {
+	enc := logfmt.NewEncoder(b)
+	if err := enc.EncodeKeyval(timeKey, line.Time.UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	if err := enc.EncodeKeyval(appKey, line.App); err != nil {
+		return err
+	}
+	for _, kv := range keyvals(line) {
+		if err := enc.EncodeKeyval(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+	if raw, ok := line.Fields[rawKey]; ok {
+		if err := enc.EncodeKeyval(rawKey, raw); err != nil {
+			return err
+		}
+	}
+	return enc.EndRecord()
+}
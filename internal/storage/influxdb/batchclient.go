@@ -1,178 +1,131 @@
 package influxdb
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"strings"
 	"time"
 
+	"github.com/Ak-Army/logcollector/internal/retry"
 	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/internal/storage/batcher"
+	"github.com/Ak-Army/logcollector/internal/storage/wal"
 
 	"github.com/Ak-Army/xlog"
 	client "github.com/influxdata/influxdb1-client/v2"
-	"go.uber.org/atomic"
 )
 
+// api is the InfluxDB API the batches are written with.
+type api interface {
+	batchConfig() client.BatchPointsConfig
+	write(ctx context.Context, batch client.BatchPoints) error
+	dropDatabase(ctx context.Context) error
+	dropMeasurement(ctx context.Context, name string) error
+	deleteByDate(ctx context.Context, name string, dateFrom, dateTo time.Time) error
+	close() error
+}
+
 type batchClient struct {
-	client         client.Client
-	batch          client.BatchPoints
-	batchWait      time.Duration
-	batchTimer     *time.Timer
-	batchSize      int
-	maxSize        int
-	log            xlog.Logger
-	entriesChannel chan pointWithSize
-	done           chan struct{}
-	sent           atomic.Int64
+	*batcher.Batcher
+	api   api
+	log   xlog.Logger
+	retry retry.Policy
 }
 
-type pointWithSize struct {
-	*client.Point
-	size int
+// New returns the InfluxDB 1.x storage, w is optional.
+func New(log xlog.Logger, conf client.HTTPConfig, database string, entryBufferSize int, batchSize int, batchWait time.Duration, policy retry.Policy, w *wal.WAL) (storage.Storage, error) {
+	cl, err := client.NewHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchClient(log, &apiV1{client: cl, database: database, log: log}, entryBufferSize, batchSize, batchWait, policy, w)
 }
 
-func New(log xlog.Logger, entryBufferSize int, batchSize int, batchWait time.Duration) storage.Storage {
-	var err error
-	c := &batchClient{
-		log:            log,
-		maxSize:        batchSize,
-		batchWait:      batchWait,
-		entriesChannel: make(chan pointWithSize, entryBufferSize),
-		done:           make(chan struct{}),
+// NewV2 returns the InfluxDB 2.x storage writing into a bucket, w is optional.
+func NewV2(log xlog.Logger, conf ConfigV2, entryBufferSize int, batchSize int, batchWait time.Duration, policy retry.Policy, w *wal.WAL) (storage.Storage, error) {
+	a, err := newAPIV2(log, conf)
+	if err != nil {
+		return nil, err
 	}
-	if c.client, err = client.NewHTTPClient(client.HTTPConfig{
-		Addr:     "http://localhost:8086",
-		Username: "admin",
-		Password: "admin",
-	}); err != nil {
-		log.Error("Unable to connect", err)
-		return nil
+	return newBatchClient(log, a, entryBufferSize, batchSize, batchWait, policy, w)
+}
+
+func newBatchClient(log xlog.Logger, a api, entryBufferSize int, batchSize int, batchWait time.Duration, policy retry.Policy, w *wal.WAL) (storage.Storage, error) {
+	c := &batchClient{
+		api:   a,
+		log:   log,
+		retry: policy,
 	}
-	if err := c.newBatchPoints(); err != nil {
-		log.Error("Unable to create batch points", err)
-		return nil
+	// the config of the points is checked once, it is the same for every batch
+	if _, err := client.NewBatchPoints(a.batchConfig()); err != nil {
+		a.close()
+		return nil, fmt.Errorf("invalid batch points config: %w", err)
 	}
-	go c.run()
-
-	return c
+	c.Batcher = batcher.New(log, c, entryBufferSize, batchSize, batchWait, w)
+	return c, nil
 }
 
-func (c *batchClient) DropDatabase() error {
-	query := client.NewQuery(fmt.Sprintf(`DROP DATABASE "%s"`, "log"), "", "")
-	c.log.Debugf("Drop database: %s", "log")
-	_, err := c.client.Query(query)
-	return err
+func (c *batchClient) DropDatabase(ctx context.Context) error {
+	return c.api.dropDatabase(ctx)
 }
 
-func (c *batchClient) DropApp(app string) error {
-	query := client.NewQuery(fmt.Sprintf(`DROP MEASUREMENT "%s"`, app), "log", "")
-	c.log.Debugf("DROP MEASUREMENT %s", app)
-	_, err := c.client.Query(query)
-	return err
+func (c *batchClient) DropApp(ctx context.Context, app string) error {
+	return c.api.dropMeasurement(ctx, app)
 }
 
-func (c *batchClient) DeleteByDate(app string, dateFrom, dateTo time.Time) error {
-	query := client.NewQuery(
-		fmt.Sprintf(`DELETE FROM "%s" WHERE time < '%s' and time > '%s'`,
-			app,
-			dateFrom.Format("20060102"),
-			dateTo.Format("20060102"),
-		),
-		"log",
-		"",
-	)
-	c.log.Debugf("Delete by date database: %s %s->%s", app, dateFrom, dateTo)
-	if _, err := c.client.Query(query); err != nil {
-		c.log.Error("Unable to create database", err)
+func (c *batchClient) DeleteByDate(ctx context.Context, app string, dateFrom, dateTo time.Time) error {
+	if err := c.api.deleteByDate(ctx, app, dateFrom, dateTo); err != nil {
+		c.log.Error("Unable to delete by date", err)
 		return err
 	}
 	return nil
 }
 
-func (c *batchClient) Send(line storage.LogLine) error {
+// Encode returns the point of the line.
+func (c *batchClient) Encode(line storage.LogLine) (interface{}, int, error) {
 	p, err := client.NewPoint(line.App, line.Tags, line.Fields, line.Time)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	c.entriesChannel <- pointWithSize{p, line.Size}
-	return nil
+	return p, line.Size, nil
 }
 
-func (c *batchClient) Stop() error {
-	close(c.entriesChannel)
-	<-c.done
-	return c.client.Close()
-}
-
-func (c *batchClient) AlreadySent() int64 {
-	return c.sent.Swap(0)
-}
-
-func (c *batchClient) run() {
-	c.batchTimer = time.NewTimer(c.batchWait)
-	defer func() {
-		if c.batch != nil && len(c.batch.Points()) > 0 {
-			if c.write() {
-				c.log.Warn("unable to send data")
-			}
-		}
-		close(c.done)
-	}()
-	currSize := 0
-	for {
-		select {
-		case ll, ok := <-c.entriesChannel:
-			if !ok {
-				return
-			}
-			currSize += ll.size
-			if currSize > c.maxSize {
-				if c.write() {
-					c.log.Warn("unable to send data")
-				}
-				currSize = ll.size
-			}
-			c.batch.AddPoint(ll.Point)
-		case <-c.batchTimer.C:
-			if len(c.batch.Points()) > 0 {
-				if c.write() {
-					c.log.Warn("unable to send data")
-				}
-				currSize = 0
-			}
-			c.batchTimer.Reset(c.batchWait)
-		}
+// Stop sends the remaining lines until the context is done and closes the client.
+func (c *batchClient) Stop(ctx context.Context) error {
+	err := c.Batcher.Stop(ctx)
+	if err := c.api.close(); err != nil {
+		c.log.Error("Unable to close client: ", err)
 	}
+	return err
 }
 
-func (c *batchClient) newBatchPoints() error {
-	var err error
-	if c.batch, err = client.NewBatchPoints(client.BatchPointsConfig{
-		Database: "log",
-	}); err != nil {
-		return err
+// Write sends the batch, the points of a field type conflict are dropped by the database with a partial write.
+// The database writes the other points, so the lines of a partial write are only counted, not reported as rejected.
+func (c *batchClient) Write(ctx context.Context, batch *batcher.Batch) (int, error) {
+	points, err := client.NewBatchPoints(c.api.batchConfig())
+	if err != nil {
+		return len(batch.Entries), err
 	}
-	return nil
-}
-
-func (c *batchClient) write() bool {
-	c.sent.Add(int64(len(c.batch.Points())))
-	err := c.client.Write(c.batch)
+	for _, e := range batch.Entries {
+		points.AddPoint(e.Value.(*client.Point))
+	}
+	err = c.retry.Do(ctx, func() error {
+		return c.api.write(ctx, points)
+	}, func(attempt int, err error) {
+		c.log.Warnf("Unable to push write data, retry %d: %s", attempt, err)
+	})
 	if err != nil {
-		if strings.Contains(err.Error(), "database not found") {
-			query := client.NewQuery(fmt.Sprintf(`CREATE DATABASE "%s"`, "log"), "", "")
-			c.log.Debugf("Create database: %s", "log")
-			if _, err := c.client.Query(query); err != nil {
-				c.log.Error("Unable to create database", err)
-				return true
-			}
-		} else {
-			c.log.Error("Unable to push write data", err)
-		}
+		c.log.Error("Unable to push write data", err)
 	}
-	if err := c.newBatchPoints(); err != nil {
-		c.log.Error("Unable to create batch points", err)
-		return true
+	var partial *partialWriteError
+	if errors.As(err, &partial) {
+		dropped := partial.dropped
+		if dropped < 0 || dropped > len(batch.Entries) {
+			dropped = len(batch.Entries)
+		}
+		batch.Deliver(len(batch.Entries) - dropped)
+		batch.RejectCount(dropped, err)
+		return 0, err
 	}
-	c.batchTimer.Reset(c.batchWait)
-	return false
+	return batch.Done(err)
 }
@@ -0,0 +1,160 @@
+package influxdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+	client "github.com/influxdata/influxdb1-client/v2"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+// server is a fake InfluxDB 1.x, the points of the invalid measurement are dropped with a partial write.
+type server struct {
+	lock   sync.Mutex
+	writes []string
+	status int
+	// queries are the statements, they fail with the statement error when it is set.
+	queries        []string
+	statementError string
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r.URL.Path == "/query" {
+		s.query(w, r)
+		return
+	}
+	if r.URL.Path != "/write" {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	s.writes = append(s.writes, string(body))
+	switch {
+	case s.status != 0:
+		w.WriteHeader(s.status)
+	case strings.Contains(string(body), "invalid"):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":"partial write: field type conflict: input field \"raw\" on measurement \"invalid\" is type string, already exists as type float dropped=%d"}`,
+			strings.Count(string(body), "invalid,"))
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// query answers with 200 OK, the statement error is in the result like InfluxDB does.
+func (s *server) query(w http.ResponseWriter, r *http.Request) {
+	s.queries = append(s.queries, r.FormValue("db")+": "+r.FormValue("q"))
+	w.Header().Set("Content-Type", "application/json")
+	result := map[string]interface{}{"statement_id": 0}
+	if s.statementError != "" {
+		result["error"] = s.statementError
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{result}})
+}
+
+func newTestClient(t *testing.T, s *server) (*batchClient, func()) {
+	srv := httptest.NewServer(s)
+	c, err := New(xlog.NopLogger, client.HTTPConfig{Addr: srv.URL}, "log", 10, 1<<20, time.Hour, retry.Policy{Attempts: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*batchClient), func() {
+		c.Stop(context.Background())
+		srv.Close()
+	}
+}
+
+func line(app string, raw string) storage.LogLine {
+	return storage.LogLine{
+		App:    app,
+		Tags:   map[string]string{"host": "web1"},
+		Fields: map[string]interface{}{"raw": raw},
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Size:   len(raw),
+		Origin: storage.Origin{File: "/var/log/app.log", Line: 1, Raw: raw},
+	}
+}
+
+func TestWrite(t *testing.T) {
+	s := &server{}
+	c, stop := newTestClient(t, s)
+	defer stop()
+	ctx := context.Background()
+	for _, raw := range []string{"first", "second"} {
+		if err := c.Send(ctx, line("app", raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := "app,host=web1 raw=\"first\" 1577934245000000000\napp,host=web1 raw=\"second\" 1577934245000000000\n"
+	if len(s.writes) != 1 || s.writes[0] != want {
+		t.Errorf("writes %q, want %q", s.writes, want)
+	}
+	if st := c.Stats(); st.Delivered != 2 {
+		t.Errorf("stats %+v, want 2 delivered", st)
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+	s := &server{}
+	c, stop := newTestClient(t, s)
+	defer stop()
+	var rejected []string
+	c.OnReject(func(line storage.LogLine, reason error) {
+		rejected = append(rejected, line.Origin.Raw)
+	})
+	ctx := context.Background()
+	for _, l := range []storage.LogLine{line("app", "first"), line("invalid", "conflict"), line("app", "second")} {
+		if err := c.Send(ctx, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(ctx); err == nil || !retry.IsPermanent(err) {
+		t.Fatalf("flush error %v, want the partial write", err)
+	}
+	// the partial write is not retried
+	if len(s.writes) != 1 {
+		t.Errorf("%d writes, want 1", len(s.writes))
+	}
+	// the database does not tell which point was dropped, the written ones are not reported
+	if len(rejected) != 0 {
+		t.Errorf("rejected %v, want none reported", rejected)
+	}
+	if st := c.Stats(); st.Delivered != 2 || st.Rejected != 1 || st.Failed != 0 {
+		t.Errorf("stats %+v, want 2 delivered and 1 rejected", st)
+	}
+}
+
+func TestWriteTemporaryFailure(t *testing.T) {
+	s := &server{status: http.StatusServiceUnavailable}
+	c, stop := newTestClient(t, s)
+	defer stop()
+	ctx := context.Background()
+	if err := c.Send(ctx, line("app", "first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(ctx); err == nil || retry.IsPermanent(err) {
+		t.Fatalf("flush error %v, want a temporary error", err)
+	}
+	if len(s.writes) != 2 {
+		t.Errorf("%d writes, want the 2 attempts", len(s.writes))
+	}
+	if st := c.Stats(); st.Failed != 1 {
+		t.Errorf("stats %+v, want 1 failed", st)
+	}
+}
@@ -0,0 +1,146 @@
+package influxdb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+	client "github.com/influxdata/influxdb1-client/v2"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+)
+
+// apiV1 writes into a database of InfluxDB 1.x with InfluxQL queries.
+type apiV1 struct {
+	client   client.Client
+	database string
+	log      xlog.Logger
+}
+
+func (a *apiV1) batchConfig() client.BatchPointsConfig {
+	return client.BatchPointsConfig{
+		Database: a.database,
+	}
+}
+
+// write sends the batch, the database is created when it does not exist.
+func (a *apiV1) write(ctx context.Context, batch client.BatchPoints) error {
+	err := do(ctx, func() error {
+		return a.client.Write(batch)
+	})
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(err.Error(), "database not found") {
+		a.log.Debugf("Create database: %s", a.database)
+		if err := a.query(ctx, fmt.Sprintf(`CREATE DATABASE "%s"`, a.database), ""); err != nil {
+			a.log.Error("Unable to create database", err)
+		}
+		return err
+	}
+	if strings.Contains(err.Error(), "partial write") {
+		return retry.Permanent(partialWrite(err))
+	}
+	if strings.Contains(err.Error(), "unable to parse") {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+var droppedPattern = regexp.MustCompile(`dropped=(\d+)`)
+
+// partialWriteError is a write of which the database dropped some points, the others are written.
+type partialWriteError struct {
+	// dropped is -1 when the response does not tell it.
+	dropped int
+	err     error
+}
+
+func (e *partialWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partialWriteError) Unwrap() error {
+	return e.err
+}
+
+// partialWrite returns the error with the number of the dropped points of the response.
+func partialWrite(err error) error {
+	p := &partialWriteError{dropped: -1, err: err}
+	if m := droppedPattern.FindStringSubmatch(err.Error()); m != nil {
+		p.dropped, _ = strconv.Atoi(m[1])
+	}
+	return p
+}
+
+// query runs the command, the errors of the statements are returned with a 200 response.
+func (a *apiV1) query(ctx context.Context, command string, database string) error {
+	query := client.NewQuery(command, database, "")
+	return do(ctx, func() error {
+		resp, err := a.client.Query(query)
+		if err != nil {
+			return err
+		}
+		return resp.Error()
+	})
+}
+
+// databaseNotFound reports whether the database does not exist yet, there is nothing to delete from it then.
+func databaseNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "database not found")
+}
+
+func (a *apiV1) dropDatabase(ctx context.Context) error {
+	a.log.Debugf("Drop database: %s", a.database)
+	return a.query(ctx, fmt.Sprintf(`DROP DATABASE "%s"`, a.database), "")
+}
+
+func (a *apiV1) dropMeasurement(ctx context.Context, name string) error {
+	a.log.Debugf("DROP MEASUREMENT %s", name)
+	err := a.query(ctx, fmt.Sprintf(`DROP MEASUREMENT "%s"`, name), a.database)
+	if databaseNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (a *apiV1) deleteByDate(ctx context.Context, name string, dateFrom, dateTo time.Time) error {
+	a.log.Debugf("Delete by date database: %s %s->%s", name, dateFrom, dateTo)
+	err := a.query(ctx,
+		fmt.Sprintf(`DELETE FROM "%s" WHERE time >= '%s' AND time < '%s'`,
+			name,
+			dateFrom.UTC().Format(time.RFC3339Nano),
+			dateTo.UTC().Format(time.RFC3339Nano),
+		),
+		a.database,
+	)
+	if databaseNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (a *apiV1) close() error {
+	return a.client.Close()
+}
+
+// do calls fn and returns when it is done or the context is done, the client has no context support.
+func do(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,54 @@
+package influxdb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeleteByDate(t *testing.T) {
+	s := &server{}
+	c, stop := newTestClient(t, s)
+	defer stop()
+	from := time.Date(2020, 1, 2, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	if err := c.DeleteByDate(context.Background(), "app", from, from.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`log: DELETE FROM "app" WHERE time >= '2020-01-01T23:00:00Z' AND time < '2020-01-02T23:00:00Z'`}
+	if !reflect.DeepEqual(s.queries, want) {
+		t.Errorf("queries %v, want %v", s.queries, want)
+	}
+}
+
+func TestStatementError(t *testing.T) {
+	s := &server{statementError: "error parsing query: found EOF"}
+	c, stop := newTestClient(t, s)
+	defer stop()
+	ctx := context.Background()
+	from := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := c.DeleteByDate(ctx, "app", from, from.AddDate(0, 0, 1)); err == nil || err.Error() != s.statementError {
+		t.Errorf("delete error %v, want the statement error", err)
+	}
+	if err := c.DropApp(ctx, "app"); err == nil {
+		t.Error("drop without the statement error")
+	}
+	if err := c.DropDatabase(ctx); err == nil {
+		t.Error("drop database without the statement error")
+	}
+}
+
+func TestDeleteDatabaseNotFound(t *testing.T) {
+	s := &server{statementError: "database not found: log"}
+	c, stop := newTestClient(t, s)
+	defer stop()
+	ctx := context.Background()
+	// nothing was written yet
+	from := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := c.DeleteByDate(ctx, "app", from, from.AddDate(0, 0, 1)); err != nil {
+		t.Errorf("delete error %v, want none", err)
+	}
+	if err := c.DropApp(ctx, "app"); err != nil {
+		t.Errorf("drop error %v, want none", err)
+	}
+}
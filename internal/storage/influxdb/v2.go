@@ -0,0 +1,229 @@
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+	client "github.com/influxdata/influxdb1-client/v2"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+)
+
+// ConfigV2 of the InfluxDB 2.x API.
+type ConfigV2 struct {
+	URL    string
+	Org    string
+	Bucket string
+	Token  string
+	// Precision of the timestamps: ns, us, ms or s, the default is ns.
+	Precision string
+	// Gzip compresses the written lines.
+	Gzip bool
+}
+
+// apiV2 writes into a bucket of InfluxDB 2.x with the line protocol.
+type apiV2 struct {
+	client *http.Client
+	conf   ConfigV2
+	log    xlog.Logger
+}
+
+// precisions maps the precisions of the v2 API to the ones the timestamps of the points are formatted with.
+// The batch points are configured with the precisions of the v2 API, they are valid durations units.
+var precisions = map[string]string{
+	"ns": "n",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+func newAPIV2(log xlog.Logger, conf ConfigV2) (*apiV2, error) {
+	if conf.Precision == "" {
+		conf.Precision = "ns"
+	}
+	if _, ok := precisions[conf.Precision]; !ok {
+		return nil, fmt.Errorf("unknown precision: %s", conf.Precision)
+	}
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+	return &apiV2{
+		client: &http.Client{Timeout: 120 * time.Second},
+		conf:   conf,
+		log:    log,
+	}, nil
+}
+
+func (a *apiV2) batchConfig() client.BatchPointsConfig {
+	return client.BatchPointsConfig{
+		Precision: a.conf.Precision,
+	}
+}
+
+// do sends the request and returns the response body.
+// The client errors, except 429 Too Many Requests, are permanent.
+func (a *apiV2) do(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) ([]byte, int, error) {
+	u := a.conf.URL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Token "+a.conf.Token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			err = retry.Permanent(err)
+		}
+		return data, resp.StatusCode, err
+	}
+	return data, resp.StatusCode, nil
+}
+
+// write sends the batch as line protocol, the bucket is created when it does not exist.
+func (a *apiV2) write(ctx context.Context, batch client.BatchPoints) error {
+	var body bytes.Buffer
+	precision := precisions[batch.Precision()]
+	for _, p := range batch.Points() {
+		body.WriteString(p.PrecisionString(precision))
+		body.WriteByte('\n')
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	data := body.Bytes()
+	if a.conf.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+	query := url.Values{}
+	query.Set("org", a.conf.Org)
+	query.Set("bucket", a.conf.Bucket)
+	query.Set("precision", a.conf.Precision)
+	_, status, err := a.do(ctx, http.MethodPost, "/api/v2/write", query, header, data)
+	if status == http.StatusNotFound && strings.Contains(err.Error(), "bucket") {
+		if err := a.createBucket(ctx); err != nil {
+			a.log.Error("Unable to create bucket", err)
+			return err
+		}
+		// written again by the retry
+		return fmt.Errorf("bucket created: %s", a.conf.Bucket)
+	}
+	return err
+}
+
+// createBucket creates the bucket in the org without a retention.
+func (a *apiV2) createBucket(ctx context.Context) error {
+	a.log.Debugf("Create bucket: %s", a.conf.Bucket)
+	data, _, err := a.do(ctx, http.MethodGet, "/api/v2/orgs", url.Values{"org": {a.conf.Org}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var orgs struct {
+		Orgs []struct {
+			ID string `json:"id"`
+		} `json:"orgs"`
+	}
+	if err := json.Unmarshal(data, &orgs); err != nil {
+		return fmt.Errorf("invalid orgs response: %w", err)
+	}
+	if len(orgs.Orgs) == 0 {
+		return retry.Permanent(fmt.Errorf("org not found: %s", a.conf.Org))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"orgID":          orgs.Orgs[0].ID,
+		"name":           a.conf.Bucket,
+		"retentionRules": []interface{}{},
+	})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	_, status, err := a.do(ctx, http.MethodPost, "/api/v2/buckets", nil, header, body)
+	if status == http.StatusUnprocessableEntity {
+		// created in the meantime
+		return nil
+	}
+	return err
+}
+
+// delete deletes the points of the range matching the predicate, an empty predicate matches every point.
+func (a *apiV2) delete(ctx context.Context, start, stop time.Time, predicate string) error {
+	body, err := json.Marshal(map[string]string{
+		"start":     start.UTC().Format(time.RFC3339Nano),
+		"stop":      stop.UTC().Format(time.RFC3339Nano),
+		"predicate": predicate,
+	})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	query := url.Values{}
+	query.Set("org", a.conf.Org)
+	query.Set("bucket", a.conf.Bucket)
+	_, _, err = a.do(ctx, http.MethodPost, "/api/v2/delete", query, header, body)
+	return err
+}
+
+// The range of the timestamps of InfluxDB, the bounds of int64 are reserved.
+var (
+	minTime = time.Unix(0, math.MinInt64+2)
+	maxTime = time.Unix(0, math.MaxInt64-1)
+)
+
+// dropDatabase deletes every point of the bucket, the bucket is kept.
+func (a *apiV2) dropDatabase(ctx context.Context) error {
+	a.log.Debugf("Delete bucket data: %s", a.conf.Bucket)
+	return a.delete(ctx, minTime, maxTime, "")
+}
+
+func (a *apiV2) dropMeasurement(ctx context.Context, name string) error {
+	a.log.Debugf("Delete measurement: %s", name)
+	return a.delete(ctx, minTime, maxTime, measurementPredicate(name))
+}
+
+// deleteByDate deletes the points of the half-open range, the stop of the delete API is inclusive.
+func (a *apiV2) deleteByDate(ctx context.Context, name string, dateFrom, dateTo time.Time) error {
+	a.log.Debugf("Delete by date bucket: %s %s->%s", name, dateFrom, dateTo)
+	return a.delete(ctx, dateFrom, dateTo.Add(-time.Nanosecond), measurementPredicate(name))
+}
+
+func measurementPredicate(name string) string {
+	return `_measurement="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+func (a *apiV2) close() error {
+	return nil
+}
@@ -0,0 +1,172 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+)
+
+// serverV2 is a fake InfluxDB 2.x, the writes fail with 404 until the bucket is created.
+type serverV2 struct {
+	lock       sync.Mutex
+	bucket     bool
+	writes     []string
+	precisions []string
+	buckets    []map[string]interface{}
+	deletes    []map[string]string
+}
+
+func (s *serverV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r.Header.Get("Authorization") != "Token secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/api/v2/write":
+		if r.FormValue("org") != "org" || r.FormValue("bucket") != "logs" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !s.bucket {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"not found","message":"bucket \"logs\" not found"}`))
+			return
+		}
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		data, _ := ioutil.ReadAll(body)
+		s.writes = append(s.writes, string(data))
+		s.precisions = append(s.precisions, r.FormValue("precision"))
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v2/orgs":
+		json.NewEncoder(w).Encode(map[string]interface{}{"orgs": []interface{}{map[string]string{"id": "42"}}})
+	case "/api/v2/buckets":
+		var bucket map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&bucket)
+		s.buckets = append(s.buckets, bucket)
+		s.bucket = true
+		w.WriteHeader(http.StatusCreated)
+	case "/api/v2/delete":
+		var del map[string]string
+		json.NewDecoder(r.Body).Decode(&del)
+		s.deletes = append(s.deletes, del)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestClientV2(t *testing.T, s *serverV2, precision string, gzip bool) (*batchClient, func()) {
+	srv := httptest.NewServer(s)
+	conf := ConfigV2{URL: srv.URL, Org: "org", Bucket: "logs", Token: "secret", Precision: precision, Gzip: gzip}
+	c, err := NewV2(xlog.NopLogger, conf, 10, 1<<20, time.Hour, retry.Policy{Attempts: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*batchClient), func() {
+		c.Stop(context.Background())
+		srv.Close()
+	}
+}
+
+func TestWriteV2(t *testing.T) {
+	for _, tt := range []struct {
+		precision string
+		query     string
+		timestamp string
+	}{
+		{"", "ns", "1577934245000000000"},
+		{"ns", "ns", "1577934245000000000"},
+		{"us", "us", "1577934245000000"},
+		{"ms", "ms", "1577934245000"},
+		{"s", "s", "1577934245"},
+	} {
+		for _, gzip := range []bool{false, true} {
+			s := &serverV2{bucket: true}
+			c, stop := newTestClientV2(t, s, tt.precision, gzip)
+			ctx := context.Background()
+			if err := c.Send(ctx, line("app", "first")); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Flush(ctx); err != nil {
+				t.Fatalf("%s gzip %v: %s", tt.precision, gzip, err)
+			}
+			stop()
+			want := []string{"app,host=web1 raw=\"first\" " + tt.timestamp + "\n"}
+			if !reflect.DeepEqual(s.writes, want) {
+				t.Errorf("%s gzip %v: writes %q, want %q", tt.precision, gzip, s.writes, want)
+			}
+			if !reflect.DeepEqual(s.precisions, []string{tt.query}) {
+				t.Errorf("%s gzip %v: precisions %v, want %s", tt.precision, gzip, s.precisions, tt.query)
+			}
+		}
+	}
+}
+
+func TestUnknownPrecisionV2(t *testing.T) {
+	if _, err := NewV2(xlog.NopLogger, ConfigV2{Precision: "n"}, 10, 1<<20, time.Hour, retry.Policy{}, nil); err == nil {
+		t.Error("no error of the unknown precision")
+	}
+}
+
+func TestCreateBucketV2(t *testing.T) {
+	s := &serverV2{}
+	c, stop := newTestClientV2(t, s, "ns", false)
+	defer stop()
+	ctx := context.Background()
+	if err := c.Send(ctx, line("app", "first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{{"orgID": "42", "name": "logs", "retentionRules": []interface{}{}}}
+	if !reflect.DeepEqual(s.buckets, want) {
+		t.Errorf("buckets %v, want %v", s.buckets, want)
+	}
+	// written again after the bucket is created
+	if len(s.writes) != 1 {
+		t.Errorf("%d writes, want 1", len(s.writes))
+	}
+}
+
+func TestDeleteV2(t *testing.T) {
+	s := &serverV2{bucket: true}
+	c, stop := newTestClientV2(t, s, "ns", false)
+	defer stop()
+	ctx := context.Background()
+	from := time.Date(2020, 1, 2, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	if err := c.DeleteByDate(ctx, "app", from, from.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DropApp(ctx, `a"pp`); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]string{
+		{"start": "2020-01-01T23:00:00Z", "stop": "2020-01-02T22:59:59.999999999Z", "predicate": `_measurement="app"`},
+		{"start": minTime.UTC().Format(time.RFC3339Nano), "stop": maxTime.UTC().Format(time.RFC3339Nano), "predicate": `_measurement="a\"pp"`},
+	}
+	if !reflect.DeepEqual(s.deletes, want) {
+		t.Errorf("deletes %v, want %v", s.deletes, want)
+	}
+}
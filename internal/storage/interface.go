@@ -1,6 +1,17 @@
 package storage
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrPending is returned by Flush when sent lines are written only later, like the rows of a parquet file written when it is closed.
+// They are not delivered yet, the lines sent before the Flush can be sent again when the process stops.
+var ErrPending = errors.New("lines are not written until the file is closed")
+
+// ErrNotSupported is returned by the drop and delete methods of the storages which can not delete the stored lines.
+var ErrNotSupported = errors.New("deleting is not supported by the storage")
 
 type LogLine struct {
 	App    string
@@ -8,12 +19,38 @@ type LogLine struct {
 	Fields map[string]interface{}
 	Time   time.Time
 	Size   int
+	// Origin is not stored, it is kept to report the rejected lines.
+	Origin Origin
+}
+
+// Origin is where the log line was read from.
+type Origin struct {
+	Source string
+	File   string
+	Line   int
+	Raw    string
+}
+
+// RejectFunc is called with the lines the backend did not accept.
+type RejectFunc func(line LogLine, reason error)
+
+// Rejecter is implemented by the storages which can reject lines after Send returned, e.g. when a batch is refused.
+type Rejecter interface {
+	OnReject(RejectFunc)
 }
 
 type Storage interface {
-	Send(LogLine) error
-	Stop() error
-	DropApp(app string) error
-	DeleteByDate(app string, dateFrom time.Time, dateTo time.Time) error
-	DropDatabase() error
+	// Send queues the line, it blocks while the queue is full until the context is done.
+	Send(ctx context.Context, line LogLine) error
+	// Flush writes the buffered entries, it returns the first write error since the previous Flush
+	// or ErrPending when entries are still buffered.
+	Flush(ctx context.Context) error
+	// Stats returns the delivery counters.
+	Stats() Stats
+	// Stop writes the remaining entries until the context is done,
+	// it returns an *UndeliveredError when entries were not delivered.
+	Stop(ctx context.Context) error
+	DropApp(ctx context.Context, app string) error
+	DeleteByDate(ctx context.Context, app string, dateFrom time.Time, dateTo time.Time) error
+	DropDatabase(ctx context.Context) error
 }
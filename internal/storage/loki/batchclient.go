@@ -1,50 +1,47 @@
 package loki
 
 import (
+	"context"
+	"net/http"
 	"sort"
 	"time"
 
 	"github.com/Ak-Army/xlog"
-	"github.com/uber-go/atomic"
 
+	"github.com/Ak-Army/logcollector/internal/retry"
 	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/internal/storage/batcher"
+	"github.com/Ak-Army/logcollector/internal/storage/wal"
 	"github.com/Ak-Army/logcollector/proto/loki"
 )
 
 type batchClient struct {
-	client         *Client
-	batch          batchEntries
-	batchWait      time.Duration
-	batchTimer     *time.Timer
-	batchSize      int
-	maxSize        int
-	log            xlog.Logger
-	entriesChannel chan *Entry
-	done           chan interface{}
-	sent           atomic.Int64
+	*batcher.Batcher
+	client *Client
+	log    xlog.Logger
+	retry  retry.Policy
 }
 
-func New(log xlog.Logger, entryBufferSize int, batchSize int, batchWait time.Duration) storage.Storage {
-	bc := &batchClient{
-		client:         NewClient(log),
-		log:            log,
-		maxSize:        batchSize,
-		batchWait:      batchWait,
-		entriesChannel: make(chan *Entry, entryBufferSize),
-		done:           make(chan interface{}),
-		batch:          make(batchEntries),
+// New returns the Loki storage, w is optional.
+func New(log xlog.Logger, url string, entryBufferSize int, batchSize int, batchWait time.Duration, policy retry.Policy, w *wal.WAL) storage.Storage {
+	c := &batchClient{
+		client: NewClient(log, url),
+		log:    log,
+		retry:  policy,
 	}
-	go bc.run()
-
-	return bc
+	c.Batcher = batcher.New(log, c, entryBufferSize, batchSize, batchWait, w)
+	return c
 }
 
-func (c *batchClient) Send(line storage.LogLine) error {
+// Encode returns the entry of the line, the size of the batch is the size of the log lines.
+func (c *batchClient) Encode(line storage.LogLine) (interface{}, int, error) {
+	// the raw field can be left out by the fanout fields
+	raw, _ := line.Fields["raw"].(string)
 	e := &Entry{
 		Labels: Labels{},
 		Entry: loki.Entry{
 			Timestamp: line.Time,
-			Line:      line.Fields["raw"].(string),
+			Line:      raw,
 		},
 	}
 	e.Labels.Add("app", line.App)
@@ -56,73 +53,54 @@ func (c *batchClient) Send(line storage.LogLine) error {
 	for _, k := range keys {
 		e.Labels.Add(k, line.Tags[k])
 	}
-	c.entriesChannel <- e
-	return nil
-}
-
-func (c *batchClient) DropDatabase() error {
-	return nil
+	return e, len(raw), nil
 }
 
-func (c *batchClient) DropApp(app string) error {
-	return nil
+// DropDatabase is not supported, the logs can not be deleted with the push API of Loki.
+func (c *batchClient) DropDatabase(ctx context.Context) error {
+	return storage.ErrNotSupported
 }
 
-func (c *batchClient) DeleteByDate(app string, dateFrom, dateTo time.Time) error {
-	return nil
+// DropApp is not supported, the logs can not be deleted with the push API of Loki.
+func (c *batchClient) DropApp(ctx context.Context, app string) error {
+	return storage.ErrNotSupported
 }
 
-func (c *batchClient) Stop() error {
-	close(c.entriesChannel)
-	<-c.done
-	return nil
+// DeleteByDate is not supported, the logs can not be deleted with the push API of Loki.
+func (c *batchClient) DeleteByDate(ctx context.Context, app string, dateFrom, dateTo time.Time) error {
+	return storage.ErrNotSupported
 }
 
-func (c *batchClient) run() {
-	c.batchTimer = time.NewTimer(c.batchWait)
-	defer func() {
-		if c.batch != nil && len(c.batch) > 0 {
-			c.write()
-		}
-		close(c.done)
-	}()
-
-	for {
-		select {
-		case ll, ok := <-c.entriesChannel:
-			if !ok {
-				return
-			}
-			fp := ll.Labels.String()
-			stream, ok := c.batch[fp]
-			if !ok {
-				stream = &loki.Stream{
-					Labels: fp,
-				}
-				c.batch[fp] = stream
+// Write sends the batch, it is rejected with a client error, like out of order entries.
+func (c *batchClient) Write(ctx context.Context, batch *batcher.Batch) (int, error) {
+	streams := make(batchEntries)
+	for _, e := range batch.Entries {
+		entry := e.Value.(*Entry)
+		fp := entry.Labels.String()
+		stream, ok := streams[fp]
+		if !ok {
+			stream = &loki.Stream{
+				Labels: fp,
 			}
-			stream.Entries = append(stream.Entries, ll.Entry)
-			c.batchSize += len(ll.Line)
-			if c.batchSize > c.maxSize {
-				c.write()
-			}
-		case <-c.batchTimer.C:
-			if len(c.batch) > 0 {
-				c.write()
-			}
-			c.batchTimer.Reset(c.batchWait)
+			streams[fp] = stream
 		}
+		stream.Entries = append(stream.Entries, entry.Entry)
 	}
-}
-
-func (c *batchClient) write() {
-	for _, stream := range c.batch {
+	for _, stream := range streams {
 		sort.Sort(batchEntriesSortable{values: stream.Entries, size: len(stream.Entries), comparator: timeSort})
 	}
-	if _, err := c.client.send(c.batch); err != nil {
+	err := c.retry.Do(ctx, func() error {
+		resp, err := c.client.send(ctx, streams)
+		if err != nil && resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusTooManyRequests {
+			return retry.Permanent(err)
+		}
+		return err
+	}, func(attempt int, err error) {
+		c.log.Warnf("Batch send error, retry %d: %s", attempt, err)
+	})
+	if err != nil {
 		c.log.Error("Batch send error: ", err)
 	}
-	c.batchSize = 0
-	c.batch = make(batchEntries)
-	c.batchTimer.Reset(c.batchWait)
+	return batch.Done(err)
 }
@@ -2,6 +2,7 @@ package loki
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"time"
 
@@ -18,12 +19,12 @@ type Client struct {
 	log    xlog.Logger
 }
 
-func NewClient(log xlog.Logger) *Client {
+func NewClient(log xlog.Logger, url string) *Client {
 	c := &Client{
 		client: httpClient.New(),
 		log:    log,
 	}
-	c.client.Base("http://localhost:3100").
+	c.client.Base(url).
 		Middleware(middleware.NewLoggerWrapper(log)).
 		Middleware(middleware.NewTimeoutWrapper(120 * time.Second)).
 		Middleware(middleware.NewRetryWrapper(3, func(request *http.Request, response *http.Response, err error) bool {
@@ -39,17 +40,17 @@ func NewClient(log xlog.Logger) *Client {
 	return c
 }
 
-func (c *Client) Send(e *Entry) (*http.Response, error) {
+func (c *Client) Send(ctx context.Context, e *Entry) (*http.Response, error) {
 	be := make(batchEntries)
 	fp := e.Labels.String()
 	be[fp] = &loki.Stream{
 		Labels:  fp,
 		Entries: []loki.Entry{e.Entry},
 	}
-	return c.send(be)
+	return c.send(ctx, be)
 }
 
-func (c *Client) send(b batchEntries) (*http.Response, error) {
+func (c *Client) send(ctx context.Context, b batchEntries) (*http.Response, error) {
 	errors := &bytes.Buffer{}
 	defer func() {
 		xlog.Debug("response: ", errors.String())
@@ -60,5 +61,5 @@ func (c *Client) send(b batchEntries) (*http.Response, error) {
 		return nil, err
 	}
 
-	return cc.Do(req, errors, errors)
+	return cc.Do(req.WithContext(ctx), errors, errors)
 }
@@ -0,0 +1,113 @@
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/internal/storage/batcher"
+	"github.com/Ak-Army/logcollector/internal/storage/wal"
+	"github.com/Ak-Army/logcollector/proto/otlp"
+)
+
+// record is the LogRecord of a line with its resource.
+type record struct {
+	app    string
+	host   string
+	record *otlp.LogRecord
+}
+
+type batchClient struct {
+	*batcher.Batcher
+	client *Client
+	log    xlog.Logger
+	retry  retry.Policy
+}
+
+// New returns the storage exporting the lines as OTLP log records over HTTP, w is optional.
+// The app is the service.name and the host tag is the host.name of the resource.
+func New(log xlog.Logger, conf Config, entryBufferSize int, batchSize int, batchWait time.Duration, policy retry.Policy, w *wal.WAL) storage.Storage {
+	c := &batchClient{
+		client: NewClient(conf),
+		log:    log,
+		retry:  policy,
+	}
+	c.Batcher = batcher.New(log, c, entryBufferSize, batchSize, batchWait, w)
+	return c
+}
+
+// Encode returns the record of the line.
+func (c *batchClient) Encode(line storage.LogLine) (interface{}, int, error) {
+	r := record{
+		app:    line.App,
+		host:   line.Tags["host"],
+		record: logRecord(line, time.Now().UnixNano()),
+	}
+	return r, r.record.Size(), nil
+}
+
+// DropDatabase is not supported, the logs can not be deleted with OTLP.
+func (c *batchClient) DropDatabase(ctx context.Context) error {
+	return storage.ErrNotSupported
+}
+
+// DropApp is not supported, the logs can not be deleted with OTLP.
+func (c *batchClient) DropApp(ctx context.Context, app string) error {
+	return storage.ErrNotSupported
+}
+
+// DeleteByDate is not supported, the logs can not be deleted with OTLP.
+func (c *batchClient) DeleteByDate(ctx context.Context, app string, dateFrom, dateTo time.Time) error {
+	return storage.ErrNotSupported
+}
+
+// Write exports the batch with a resource per app and host.
+func (c *batchClient) Write(ctx context.Context, batch *batcher.Batch) (int, error) {
+	type resource struct {
+		app, host string
+	}
+	var order []resource
+	records := make(map[resource][]*otlp.LogRecord)
+	for _, e := range batch.Entries {
+		r := e.Value.(record)
+		key := resource{app: r.app, host: r.host}
+		if _, ok := records[key]; !ok {
+			order = append(order, key)
+		}
+		records[key] = append(records[key], r.record)
+	}
+	resources := make([]*otlp.ResourceLogs, 0, len(order))
+	for _, key := range order {
+		resources = append(resources, resourceLogs(key.app, key.host, records[key]))
+	}
+
+	var rejected int64
+	var message string
+	err := c.retry.Do(ctx, func() error {
+		var err error
+		rejected, message, err = c.client.export(ctx, resources)
+		return err
+	}, func(attempt int, err error) {
+		c.log.Warnf("Unable to export, retry %d: %s", attempt, err)
+	})
+	if err != nil {
+		c.log.Error("Unable to export: ", err)
+		return batch.Done(err)
+	}
+	if message != "" {
+		c.log.Warnf("Partial success, %d records rejected: %s", rejected, message)
+	}
+	if rejected > int64(len(batch.Entries)) {
+		rejected = int64(len(batch.Entries))
+	}
+	if rejected > 0 {
+		// the response does not tell which records were rejected
+		batch.RejectCount(int(rejected), fmt.Errorf("%d records rejected: %s", rejected, message))
+	}
+	batch.Deliver(len(batch.Entries) - int(rejected))
+	return 0, nil
+}
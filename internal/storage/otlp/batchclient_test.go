@@ -0,0 +1,120 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/xlog"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/proto/otlp"
+)
+
+// collector is a fake OTLP/HTTP collector, the records with an invalid body are rejected with a partial success.
+type collector struct {
+	lock     sync.Mutex
+	requests []*otlp.ExportLogsServiceRequest
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+		return
+	}
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	data, _ := ioutil.ReadAll(body)
+	req := &otlp.ExportLogsServiceRequest{}
+	if err := req.Unmarshal(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.requests = append(c.requests, req)
+	var response otlp.ExportLogsServiceResponse
+	for _, rl := range req.ResourceLogs {
+		for _, sl := range rl.ScopeLogs {
+			for _, lr := range sl.LogRecords {
+				if strings.Contains(lr.Body.GetStringValue(), "invalid") {
+					if response.PartialSuccess == nil {
+						response.PartialSuccess = &otlp.ExportLogsPartialSuccess{ErrorMessage: "invalid body"}
+					}
+					response.PartialSuccess.RejectedLogRecords++
+				}
+			}
+		}
+	}
+	resp, _ := response.Marshal()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+func line(app string, host string, raw string) storage.LogLine {
+	return storage.LogLine{
+		App:    app,
+		Tags:   map[string]string{"host": host},
+		Fields: map[string]interface{}{"raw": raw},
+		Time:   time.Now(),
+		Size:   len(raw),
+	}
+}
+
+func TestExport(t *testing.T) {
+	for _, gzip := range []bool{false, true} {
+		c := &collector{}
+		srv := httptest.NewServer(c)
+		s := New(xlog.NopLogger, Config{URL: srv.URL, Gzip: gzip}, 10, 1<<20, time.Hour, retry.Policy{Attempts: 2}, nil)
+		ctx := context.Background()
+		for _, l := range []storage.LogLine{
+			line("app", "web1", "a"),
+			line("app", "web2", "invalid b"),
+			line("app", "web1", "c"),
+			line("other", "web1", "d"),
+		} {
+			if err := s.Send(ctx, l); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Flush(ctx); err == nil {
+			t.Errorf("gzip %v: flush without the rejection", gzip)
+		}
+		s.Stop(ctx)
+		srv.Close()
+
+		if len(c.requests) != 1 {
+			t.Fatalf("gzip %v: %d requests, want 1", gzip, len(c.requests))
+		}
+		// a resource per app and host in the order of the lines
+		var got []string
+		for _, rl := range c.requests[0].ResourceLogs {
+			r := rl.Resource.Attributes[0].Value.GetStringValue() + "@" + rl.Resource.Attributes[1].Value.GetStringValue() + ":"
+			for _, lr := range rl.ScopeLogs[0].LogRecords {
+				r += " " + lr.Body.GetStringValue()
+			}
+			got = append(got, r)
+		}
+		want := []string{"app@web1: a c", "app@web2: invalid b", "other@web1: d"}
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Errorf("gzip %v: resources %q, want %q", gzip, got, want)
+		}
+		if st := s.Stats(); st.Delivered != 3 || st.Rejected != 1 {
+			t.Errorf("gzip %v: stats %+v, want 3 delivered and 1 rejected", gzip, st)
+		}
+	}
+}
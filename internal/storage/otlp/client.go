@@ -0,0 +1,100 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/retry"
+	"github.com/Ak-Army/logcollector/proto/otlp"
+)
+
+// Config of the OTLP/HTTP logs endpoint.
+type Config struct {
+	// URL of the collector, the logs are posted to URL/v1/logs unless the path is already there.
+	URL string
+	// Headers are added to the requests, like the authorization.
+	Headers map[string]string
+	Gzip    bool
+}
+
+type Client struct {
+	client *http.Client
+	conf   Config
+}
+
+func NewClient(conf Config) *Client {
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+	if !strings.HasSuffix(conf.URL, "/v1/logs") {
+		conf.URL += "/v1/logs"
+	}
+	return &Client{
+		client: &http.Client{Timeout: 120 * time.Second},
+		conf:   conf,
+	}
+}
+
+// export posts the ExportLogsServiceRequest of the resource logs.
+// It returns the number of the records rejected by a partial success and its message, the message is a warning without rejected records.
+// The client errors, except 429 Too Many Requests, are permanent.
+func (c *Client) export(ctx context.Context, resources []*otlp.ResourceLogs) (int64, string, error) {
+	msg, err := (&otlp.ExportLogsServiceRequest{ResourceLogs: resources}).Marshal()
+	if err != nil {
+		return 0, "", retry.Permanent(err)
+	}
+	body := msg
+	if c.conf.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(msg); err != nil {
+			return 0, "", err
+		}
+		if err := gz.Close(); err != nil {
+			return 0, "", err
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest(http.MethodPost, c.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if c.conf.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range c.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			err = retry.Permanent(err)
+		}
+		return 0, "", err
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-protobuf") {
+		return 0, "", nil
+	}
+	var response otlp.ExportLogsServiceResponse
+	if err := response.Unmarshal(data); err != nil {
+		// the records were accepted, sending them again would duplicate them
+		return 0, "invalid export response: " + err.Error(), nil
+	}
+	partial := response.GetPartialSuccess()
+	return partial.GetRejectedLogRecords(), partial.GetErrorMessage(), nil
+}
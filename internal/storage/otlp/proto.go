@@ -0,0 +1,122 @@
+package otlp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/proto/otlp"
+)
+
+// scope is the instrumentation scope of the records.
+const scope = "logcollector"
+
+// anyValue returns the AnyValue of the value, the types other than the numbers and bool are strings.
+func anyValue(v interface{}) *otlp.AnyValue {
+	switch n := v.(type) {
+	case string:
+		return &otlp.AnyValue{Value: &otlp.AnyValue_StringValue{StringValue: n}}
+	case bool:
+		return &otlp.AnyValue{Value: &otlp.AnyValue_BoolValue{BoolValue: n}}
+	case int:
+		return &otlp.AnyValue{Value: &otlp.AnyValue_IntValue{IntValue: int64(n)}}
+	case int32:
+		return &otlp.AnyValue{Value: &otlp.AnyValue_IntValue{IntValue: int64(n)}}
+	case int64:
+		return &otlp.AnyValue{Value: &otlp.AnyValue_IntValue{IntValue: n}}
+	case float32:
+		return &otlp.AnyValue{Value: &otlp.AnyValue_DoubleValue{DoubleValue: float64(n)}}
+	case float64:
+		return &otlp.AnyValue{Value: &otlp.AnyValue_DoubleValue{DoubleValue: n}}
+	}
+	return &otlp.AnyValue{Value: &otlp.AnyValue_StringValue{StringValue: fmt.Sprint(v)}}
+}
+
+func keyValue(key string, v interface{}) *otlp.KeyValue {
+	return &otlp.KeyValue{Key: key, Value: anyValue(v)}
+}
+
+// severity returns the severity number of the level, unspecified for the unknown levels.
+func severity(level string) otlp.SeverityNumber {
+	switch strings.ToLower(level) {
+	case "trace":
+		return otlp.SEVERITY_NUMBER_TRACE
+	case "debug":
+		return otlp.SEVERITY_NUMBER_DEBUG
+	case "info", "information":
+		return otlp.SEVERITY_NUMBER_INFO
+	case "notice":
+		return otlp.SEVERITY_NUMBER_INFO2
+	case "warn", "warning":
+		return otlp.SEVERITY_NUMBER_WARN
+	case "error", "err":
+		return otlp.SEVERITY_NUMBER_ERROR
+	case "crit", "critical":
+		return otlp.SEVERITY_NUMBER_ERROR2
+	case "alert":
+		return otlp.SEVERITY_NUMBER_ERROR3
+	case "fatal", "emerg", "emergency", "panic":
+		return otlp.SEVERITY_NUMBER_FATAL
+	}
+	return otlp.SEVERITY_NUMBER_UNSPECIFIED
+}
+
+// logRecord returns the LogRecord of the line, the raw field is the body and the other tags and fields are the attributes.
+// The severity is taken from the level field.
+func logRecord(line storage.LogLine, observed int64) *otlp.LogRecord {
+	r := &otlp.LogRecord{
+		TimeUnixNano:         uint64(line.Time.UnixNano()),
+		ObservedTimeUnixNano: uint64(observed),
+	}
+	if level, ok := line.Fields["level"].(string); ok {
+		r.SeverityNumber = severity(level)
+		r.SeverityText = level
+	}
+	if raw, ok := line.Fields["raw"]; ok {
+		r.Body = anyValue(raw)
+	}
+	for _, k := range sortedKeys(line.Tags) {
+		if k == "host" {
+			continue
+		}
+		r.Attributes = append(r.Attributes, keyValue(k, line.Tags[k]))
+	}
+	keys := make([]string, 0, len(line.Fields))
+	for k := range line.Fields {
+		if k != "raw" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r.Attributes = append(r.Attributes, keyValue(k, line.Fields[k]))
+	}
+	return r
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resourceLogs returns the ResourceLogs of the records of the app on the host.
+func resourceLogs(app, host string, records []*otlp.LogRecord) *otlp.ResourceLogs {
+	resource := &otlp.Resource{
+		Attributes: []*otlp.KeyValue{keyValue("service.name", app)},
+	}
+	if host != "" {
+		resource.Attributes = append(resource.Attributes, keyValue("host.name", host))
+	}
+	return &otlp.ResourceLogs{
+		Resource: resource,
+		ScopeLogs: []*otlp.ScopeLogs{{
+			Scope:      &otlp.InstrumentationScope{Name: scope},
+			LogRecords: records,
+		}},
+	}
+}
@@ -0,0 +1,66 @@
+package otlp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+	"github.com/Ak-Army/logcollector/proto/otlp"
+)
+
+func TestResourceLogs(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	observed := now.Add(time.Second).UnixNano()
+	line := storage.LogLine{
+		App:  "app",
+		Tags: map[string]string{"host": "web1", "method": "GET"},
+		Fields: map[string]interface{}{
+			"raw":    "GET / 200",
+			"level":  "Warning",
+			"status": int64(200),
+			"port":   -1,
+			"took":   0.25,
+			"cached": true,
+		},
+		Time: now,
+	}
+	data, err := resourceLogs("app", "web1", []*otlp.LogRecord{logRecord(line, observed)}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got otlp.ResourceLogs
+	if err := got.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) *otlp.AnyValue {
+		return &otlp.AnyValue{Value: &otlp.AnyValue_StringValue{StringValue: s}}
+	}
+	want := &otlp.ResourceLogs{
+		Resource: &otlp.Resource{Attributes: []*otlp.KeyValue{
+			{Key: "service.name", Value: str("app")},
+			{Key: "host.name", Value: str("web1")},
+		}},
+		ScopeLogs: []*otlp.ScopeLogs{{
+			Scope: &otlp.InstrumentationScope{Name: "logcollector"},
+			LogRecords: []*otlp.LogRecord{{
+				TimeUnixNano:         uint64(now.UnixNano()),
+				ObservedTimeUnixNano: uint64(observed),
+				SeverityNumber:       otlp.SEVERITY_NUMBER_WARN,
+				SeverityText:         "Warning",
+				Body:                 str("GET / 200"),
+				// the host tag is an attribute of the resource
+				Attributes: []*otlp.KeyValue{
+					{Key: "method", Value: str("GET")},
+					{Key: "cached", Value: &otlp.AnyValue{Value: &otlp.AnyValue_BoolValue{BoolValue: true}}},
+					{Key: "level", Value: str("Warning")},
+					{Key: "port", Value: &otlp.AnyValue{Value: &otlp.AnyValue_IntValue{IntValue: -1}}},
+					{Key: "status", Value: &otlp.AnyValue{Value: &otlp.AnyValue_IntValue{IntValue: 200}}},
+					{Key: "took", Value: &otlp.AnyValue{Value: &otlp.AnyValue_DoubleValue{DoubleValue: 0.25}}},
+				},
+			}},
+		}},
+	}
+	if !want.Equal(&got) {
+		t.Errorf("resource logs\n%s\nwant\n%s", got.String(), want.String())
+	}
+}
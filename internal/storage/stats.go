@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Stats are the delivery counters of a storage.
+type Stats struct {
+	// Delivered entries were accepted by the backend.
+	Delivered int64
+	// Rejected entries were refused by the backend, they are passed to the RejectFunc.
+	Rejected int64
+	// Failed entries could not be written after the retries, with a WAL they are written again later.
+	Failed int64
+	// Errors is the number of the failed writes.
+	Errors int64
+}
+
+// Counters keeps the Stats of a storage, it is safe for concurrent use.
+type Counters struct {
+	delivered int64
+	rejected  int64
+	failed    int64
+	errors    int64
+}
+
+func (c *Counters) AddDelivered(n int) {
+	atomic.AddInt64(&c.delivered, int64(n))
+}
+
+// AddRejected counts a write refused by the backend.
+func (c *Counters) AddRejected(n int) {
+	atomic.AddInt64(&c.rejected, int64(n))
+	atomic.AddInt64(&c.errors, 1)
+}
+
+// AddFailed counts a write which failed after the retries.
+func (c *Counters) AddFailed(n int) {
+	atomic.AddInt64(&c.failed, int64(n))
+	atomic.AddInt64(&c.errors, 1)
+}
+
+func (c *Counters) Stats() Stats {
+	return Stats{
+		Delivered: atomic.LoadInt64(&c.delivered),
+		Rejected:  atomic.LoadInt64(&c.rejected),
+		Failed:    atomic.LoadInt64(&c.failed),
+		Errors:    atomic.LoadInt64(&c.errors),
+	}
+}
+
+// UndeliveredError is returned by Stop when entries were not delivered.
+type UndeliveredError struct {
+	Entries int64
+	Err     error
+}
+
+func (e *UndeliveredError) Error() string {
+	return fmt.Sprintf("%d entries not delivered: %s", e.Entries, e.Err)
+}
+
+func (e *UndeliveredError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,177 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+var errCorrupt = errors.New("corrupt record")
+
+// encode appends the binary form of the line to buf.
+// Field values are int64, float64, bool or string, other types are stored as string.
+func encode(buf []byte, line storage.LogLine) []byte {
+	buf = appendString(buf, line.App)
+	buf = appendUvarint(buf, uint64(len(line.Tags)))
+	for k, v := range line.Tags {
+		buf = appendString(buf, k)
+		buf = appendString(buf, v)
+	}
+	buf = appendUvarint(buf, uint64(len(line.Fields)))
+	for k, v := range line.Fields {
+		buf = appendString(buf, k)
+		switch v := v.(type) {
+		case int64:
+			buf = append(buf, 'i')
+			buf = appendVarint(buf, v)
+		case int:
+			buf = append(buf, 'i')
+			buf = appendVarint(buf, int64(v))
+		case float64:
+			buf = append(buf, 'f')
+			buf = appendUint64(buf, math.Float64bits(v))
+		case bool:
+			buf = append(buf, 'b')
+			if v {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		case string:
+			buf = append(buf, 's')
+			buf = appendString(buf, v)
+		default:
+			buf = append(buf, 's')
+			buf = appendString(buf, fmt.Sprint(v))
+		}
+	}
+	buf = appendVarint(buf, line.Time.UnixNano())
+	buf = appendUvarint(buf, uint64(line.Size))
+	buf = appendString(buf, line.Origin.Source)
+	buf = appendString(buf, line.Origin.File)
+	buf = appendUvarint(buf, uint64(line.Origin.Line))
+	buf = appendString(buf, line.Origin.Raw)
+	return buf
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func decode(buf []byte) (storage.LogLine, error) {
+	d := &decoder{buf: buf}
+	line := storage.LogLine{
+		App:    d.string(),
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+	}
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		k := d.string()
+		line.Tags[k] = d.string()
+	}
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		k := d.string()
+		switch d.byte() {
+		case 'i':
+			line.Fields[k] = d.varint()
+		case 'f':
+			line.Fields[k] = math.Float64frombits(d.uint64())
+		case 'b':
+			line.Fields[k] = d.byte() == 1
+		case 's':
+			line.Fields[k] = d.string()
+		default:
+			d.err = errCorrupt
+		}
+	}
+	line.Time = time.Unix(0, d.varint())
+	line.Size = int(d.uvarint())
+	line.Origin.Source = d.string()
+	line.Origin.File = d.string()
+	line.Origin.Line = int(d.uvarint())
+	line.Origin.Raw = d.string()
+	return line, d.err
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err != nil || len(d.buf) < 8 {
+		d.err = errCorrupt
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.err = errCorrupt
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil || uint64(len(d.buf)) < n {
+		d.err = errCorrupt
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
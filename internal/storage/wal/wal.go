@@ -0,0 +1,457 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+const (
+	headerSize = 8
+	commitFile = "commit"
+)
+
+var ErrClosed = errors.New("wal is closed")
+
+// CorruptError is returned by Next for a record which can not be read, the read position is moved after it.
+// A record which can not be decoded is skipped alone, a torn or corrupt record skips the rest of its segment,
+// its length can not be trusted.
+type CorruptError struct {
+	Seq    uint64
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("wal segment %d at %d: %s", e.Seq, e.Offset, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// WAL is a write-ahead log of the lines waiting for a storage, kept in the segment files of a directory.
+// Send appends the lines and the batch loop reads them, it commits them after they were written to the storage
+// or rewinds to the last commit when the write failed. The lines not committed are read again after a restart.
+type WAL struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	lock        sync.Mutex
+	space       *sync.Cond
+	notify      chan struct{}
+	closed      bool
+	// segments are ordered by seq, the last one is written.
+	segments []segment
+	size     int64
+	w        *os.File
+	wbuf     *bufio.Writer
+	read     position
+	commit   position
+	r        *os.File
+	rbuf     *bufio.Reader
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+type position struct {
+	seq    uint64
+	offset int64
+}
+
+// Open opens the WAL in dir, segments are rotated at segmentSize and Append blocks while the segments are
+// bigger than maxSize, 0 means no limit.
+func Open(dir string, segmentSize int64, maxSize int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && segmentSize > maxSize/2 {
+		segmentSize = maxSize / 2
+	}
+	w := &WAL{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		notify:      make(chan struct{}, 1),
+	}
+	w.space = sync.NewCond(&w.lock)
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	// the sequence goes on after the commit, so the new segments are not taken as committed
+	next := w.commit.seq + 1
+	if len(w.segments) > 0 {
+		next = w.segments[len(w.segments)-1].seq + 1
+		w.notify <- struct{}{}
+	} else {
+		w.commit = position{seq: next}
+		w.read = w.commit
+	}
+	if err := w.create(next); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// load reads the segments left by the previous run, the committed ones are removed.
+func (w *WAL) load() error {
+	if data, err := ioutil.ReadFile(filepath.Join(w.dir, commitFile)); err == nil {
+		if _, err := fmt.Sscanf(string(data), "%d %d", &w.commit.seq, &w.commit.offset); err != nil {
+			return fmt.Errorf("invalid wal commit file: %w", err)
+		}
+		w.read = w.commit
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".wal") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq < w.commit.seq || f.Size() == 0 || (seq == w.commit.seq && f.Size() <= w.commit.offset) {
+			if err := os.Remove(filepath.Join(w.dir, f.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		w.segments = append(w.segments, segment{seq: seq, size: f.Size()})
+		w.size += f.Size()
+	}
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].seq < w.segments[j].seq
+	})
+	if len(w.segments) > 0 && w.segments[0].seq != w.commit.seq {
+		w.commit = position{seq: w.segments[0].seq}
+		w.read = w.commit
+	}
+	return nil
+}
+
+func (w *WAL) path(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%016d.wal", seq))
+}
+
+// create starts a new segment for writing.
+func (w *WAL) create(seq uint64) error {
+	f, err := os.OpenFile(w.path(seq), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.w = f
+	w.wbuf = bufio.NewWriter(f)
+	w.segments = append(w.segments, segment{seq: seq})
+	return nil
+}
+
+// rotate syncs and closes the written segment and starts the next one.
+func (w *WAL) rotate() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	return w.create(w.segments[len(w.segments)-1].seq + 1)
+}
+
+func (w *WAL) sync() error {
+	if err := w.wbuf.Flush(); err != nil {
+		return err
+	}
+	return w.w.Sync()
+}
+
+// Notify receives when lines are appended.
+func (w *WAL) Notify() <-chan struct{} {
+	return w.notify
+}
+
+// Append writes the line into the WAL, it blocks while the WAL is full until the context is done.
+func (w *WAL) Append(ctx context.Context, line storage.LogLine) error {
+	rec := make([]byte, headerSize, headerSize+line.Size+256)
+	rec = encode(rec, line)
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(rec)-headerSize))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(rec[headerSize:]))
+	size := int64(len(rec))
+
+	w.lock.Lock()
+	if w.full(size) {
+		// the waiting is woken up when the context is done
+		waiting := make(chan struct{})
+		defer close(waiting)
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.lock.Lock()
+				w.space.Broadcast()
+				w.lock.Unlock()
+			case <-waiting:
+			}
+		}()
+	}
+	for w.full(size) && ctx.Err() == nil {
+		w.space.Wait()
+	}
+	if w.closed {
+		w.lock.Unlock()
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		w.lock.Unlock()
+		return err
+	}
+	current := &w.segments[len(w.segments)-1]
+	if current.size > 0 && current.size+size > w.segmentSize {
+		if err := w.rotate(); err != nil {
+			w.lock.Unlock()
+			return err
+		}
+		current = &w.segments[len(w.segments)-1]
+	}
+	_, err := w.wbuf.Write(rec)
+	current.size += size
+	w.size += size
+	w.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// full reports whether the line of the given size has to wait for space, it is called with the lock held.
+func (w *WAL) full(size int64) bool {
+	return !w.closed && w.maxSize > 0 && w.size+size > w.maxSize && len(w.segments) > 1
+}
+
+// Next returns the next line not read yet, false when there is none.
+// The records which can not be read are skipped with a CorruptError, like the torn records at the end of
+// the segments of a crashed run.
+func (w *WAL) Next() (storage.LogLine, bool, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for {
+		if w.closed {
+			return storage.LogLine{}, false, ErrClosed
+		}
+		current := w.read.seq == w.segments[len(w.segments)-1].seq
+		if current {
+			if err := w.wbuf.Flush(); err != nil {
+				return storage.LogLine{}, false, err
+			}
+		}
+		if w.r == nil {
+			f, err := os.Open(w.path(w.read.seq))
+			if err != nil {
+				return storage.LogLine{}, false, err
+			}
+			if _, err := f.Seek(w.read.offset, io.SeekStart); err != nil {
+				f.Close()
+				return storage.LogLine{}, false, err
+			}
+			w.r = f
+			w.rbuf = bufio.NewReader(f)
+		}
+		payload, err := w.readRecord(w.sizeOf(w.read.seq) - w.read.offset)
+		if err != nil {
+			if current {
+				if err == io.EOF {
+					return storage.LogLine{}, false, nil
+				}
+				return storage.LogLine{}, false, fmt.Errorf("wal segment %d: %w", w.read.seq, err)
+			}
+			w.closeReader()
+			at := w.read
+			w.read = position{seq: w.next(w.read.seq)}
+			if err == io.EOF {
+				continue
+			}
+			return storage.LogLine{}, false, &CorruptError{Seq: at.seq, Offset: at.offset, Err: err}
+		}
+		at := w.read
+		w.read.offset += int64(headerSize + len(payload))
+		line, err := decode(payload)
+		if err != nil {
+			return storage.LogLine{}, false, &CorruptError{Seq: at.seq, Offset: at.offset, Err: err}
+		}
+		return line, true, nil
+	}
+}
+
+// readRecord reads the next record, the records longer than the rest of the segment are corrupt.
+func (w *WAL) readRecord(rest int64) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(w.rbuf, header[:]); err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	if size > rest-headerSize {
+		return nil, errCorrupt
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(w.rbuf, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errCorrupt
+	}
+	return payload, nil
+}
+
+// sizeOf returns the size of the segment, the appended records are counted for the written one.
+func (w *WAL) sizeOf(seq uint64) int64 {
+	for _, s := range w.segments {
+		if s.seq == seq {
+			return s.size
+		}
+	}
+	return 0
+}
+
+// next returns the segment after seq.
+func (w *WAL) next(seq uint64) uint64 {
+	for _, s := range w.segments {
+		if s.seq > seq {
+			return s.seq
+		}
+	}
+	return seq
+}
+
+func (w *WAL) closeReader() {
+	if w.r != nil {
+		w.r.Close()
+		w.r = nil
+		w.rbuf = nil
+	}
+}
+
+// Mark is a read position of the WAL, the lines read before it can be committed by CommitTo.
+type Mark struct {
+	pos position
+}
+
+// Mark returns the read position, it is after the line returned by the last Next.
+func (w *WAL) Mark() Mark {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return Mark{pos: w.read}
+}
+
+// Commit marks the lines read so far as stored, the segments read completely are removed.
+func (w *WAL) Commit() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.commitTo(w.read)
+}
+
+// CommitTo marks the lines read before the mark as stored and rewinds to it, the lines after it are read again.
+func (w *WAL) CommitTo(m Mark) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closeReader()
+	w.read = m.pos
+	return w.commitTo(m.pos)
+}
+
+// commitTo is called with the lock held.
+func (w *WAL) commitTo(pos position) error {
+	if w.commit == pos {
+		return nil
+	}
+	w.commit = pos
+	for len(w.segments) > 1 && w.segments[0].seq < w.commit.seq {
+		if err := os.Remove(w.path(w.segments[0].seq)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.size -= w.segments[0].size
+		w.segments = w.segments[1:]
+	}
+	w.space.Broadcast()
+	return w.saveCommit()
+}
+
+// saveCommit replaces the commit file atomically, it is synced before the rename so a crash never replays
+// from a stale offset.
+func (w *WAL) saveCommit() error {
+	tmp, err := os.Create(filepath.Join(w.dir, commitFile+".tmp"))
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(tmp, "%d %d\n", w.commit.seq, w.commit.offset); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(w.dir, commitFile))
+}
+
+// Rewind moves the read position back to the last commit, the lines are read again.
+func (w *WAL) Rewind() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closeReader()
+	w.read = w.commit
+}
+
+// Sync writes the appended lines to the disk.
+func (w *WAL) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.sync()
+}
+
+// Close syncs the WAL, the lines not committed are kept for the next Open.
+func (w *WAL) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.space.Broadcast()
+	w.closeReader()
+	err := w.sync()
+	if cerr := w.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
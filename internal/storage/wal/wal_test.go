@@ -0,0 +1,329 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Ak-Army/logcollector/internal/storage"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func line(raw string) storage.LogLine {
+	return storage.LogLine{
+		App:    "app",
+		Tags:   map[string]string{"host": "web1"},
+		Fields: map[string]interface{}{"raw": raw, "status": int64(200), "took": 0.5, "ok": true},
+		Time:   time.Unix(0, 1577934245000000001),
+		Size:   len(raw),
+		Origin: storage.Origin{Source: "web", File: "/var/log/app.log", Line: 3, Raw: raw},
+	}
+}
+
+func appendLines(t *testing.T, w *WAL, raws ...string) {
+	t.Helper()
+	for _, raw := range raws {
+		if err := w.Append(context.Background(), line(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readAll returns the raw of the lines not read yet, the corrupt records are counted.
+func readAll(t *testing.T, w *WAL) ([]string, int) {
+	t.Helper()
+	var raws []string
+	corrupt := 0
+	for {
+		l, ok, err := w.Next()
+		var c *CorruptError
+		if errors.As(err, &c) {
+			corrupt++
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return raws, corrupt
+		}
+		raws = append(raws, l.Origin.Raw)
+	}
+}
+
+// record returns the payload with the header of the record.
+func record(payload []byte) []byte {
+	rec := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload))
+	return append(rec, payload...)
+}
+
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range files {
+		files[i] = filepath.Base(f)
+	}
+	return files
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	w, err := Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	appendLines(t, w, "first")
+	l, ok, err := w.Next()
+	if err != nil || !ok {
+		t.Fatalf("next %v %v", ok, err)
+	}
+	if want := line("first"); !reflect.DeepEqual(l, want) {
+		t.Errorf("line %+v, want %+v", l, want)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	// a segment holds one line
+	w, err := Open(dir, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	appendLines(t, w, "first", "second", "third")
+	want := []string{"0000000000000001.wal", "0000000000000002.wal", "0000000000000003.wal"}
+	if got := segments(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("segments %v, want %v", got, want)
+	}
+	if raws, _ := readAll(t, w); !reflect.DeepEqual(raws, []string{"first", "second", "third"}) {
+		t.Errorf("lines %v", raws)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// the written segment is kept
+	if got := segments(t, dir); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("segments after commit %v, want %v", got, want[2:])
+	}
+}
+
+func TestRewind(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	w, err := Open(dir, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	appendLines(t, w, "first")
+	readAll(t, w)
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, w, "second", "third")
+	readAll(t, w)
+	w.Rewind()
+	if raws, _ := readAll(t, w); !reflect.DeepEqual(raws, []string{"second", "third"}) {
+		t.Errorf("lines after rewind %v", raws)
+	}
+}
+
+func TestFull(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	// the segments are rotated at the half of the max size, a segment holds one line
+	w, err := Open(dir, 1<<20, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	appendLines(t, w, "first", "second")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := w.Append(ctx, line("third")); err != context.DeadlineExceeded {
+		t.Fatalf("append error %v, want to wait for the space", err)
+	}
+	appended := make(chan error, 1)
+	go func() {
+		appended <- w.Append(context.Background(), line("third"))
+	}()
+	select {
+	case err := <-appended:
+		t.Fatalf("appended %v without space", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if raws, _ := readAll(t, w); len(raws) != 2 {
+		t.Fatalf("lines %v", raws)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-appended:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked after commit")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	w, err := Open(dir, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, w, "first", "second", "third")
+	if l, _, err := w.Next(); err != nil || l.Origin.Raw != "first" {
+		t.Fatalf("next %s %v", l.Origin.Raw, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// read but not committed
+	w.Next()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Open(dir, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, w, "fourth")
+	if raws, _ := readAll(t, w); !reflect.DeepEqual(raws, []string{"second", "third", "fourth"}) {
+		t.Errorf("lines after restart %v", raws)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Open(dir, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if raws, _ := readAll(t, w); len(raws) != 0 {
+		t.Errorf("lines of the committed wal %v", raws)
+	}
+}
+
+// crash writes the lines into a segment left by a crashed run, the data is appended to the last one.
+func crash(t *testing.T, dir string, data []byte, raws ...string) {
+	t.Helper()
+	w, err := Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, w, raws...)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := segments(t, dir)
+	f, err := os.OpenFile(filepath.Join(dir, files[len(files)-1]), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	rec := record(encode(nil, line("torn")))
+	// the header of the record is written but a part of its payload is not
+	crash(t, dir, rec[:len(rec)-3], "first")
+	w, err := Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	appendLines(t, w, "second")
+	raws, corrupt := readAll(t, w)
+	if !reflect.DeepEqual(raws, []string{"first", "second"}) || corrupt != 1 {
+		t.Errorf("lines %v, %d corrupt, want the torn one", raws, corrupt)
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	w, err := Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, w, "first", "second", "third")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, segments(t, dir)[0])
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the checksum of the second record does not match
+	second := len(record(encode(nil, line("first"))))
+	data[second+headerSize+1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	appendLines(t, w, "fourth")
+	// the rest of the segment is skipped
+	raws, corrupt := readAll(t, w)
+	if !reflect.DeepEqual(raws, []string{"first", "fourth"}) || corrupt != 1 {
+		t.Errorf("lines %v, %d corrupt, want the rest of the segment skipped", raws, corrupt)
+	}
+}
+
+func TestUndecodableRecord(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	// the checksum matches but the tags are missing, only the record is skipped
+	data := append(record([]byte{1, 'x'}), record(encode(nil, line("second")))...)
+	crash(t, dir, data, "first")
+	w, err := Open(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	raws, corrupt := readAll(t, w)
+	if !reflect.DeepEqual(raws, []string{"first", "second"}) || corrupt != 1 {
+		t.Errorf("lines %v, %d corrupt, want the undecodable one", raws, corrupt)
+	}
+}
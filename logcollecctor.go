@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Ak-Army/cli"
 	"github.com/Ak-Army/cli/command"
 	"github.com/Ak-Army/xlog"
 
-	_ "github.com/Ak-Army/logcollector/cmd"
+	"github.com/Ak-Army/logcollector/cmd"
 )
 
 var logger xlog.Logger
@@ -21,12 +23,18 @@ func main() {
 	logger.SetField("version", Version)
 	logger.SetField("pid", fmt.Sprintf("%d", os.Getpid()))
 	logger.Info("start...")
-	ctx := xlog.NewContext(context.Background(), logger)
+	ctx, cancel := context.WithCancel(xlog.NewContext(context.Background(), logger))
+	defer cancel()
+	go stopOnSignal(cancel)
 
 	c := cli.New("log collector", Version)
 	cli.RootCommand().Authors = []string{"Hunyi"}
 	cli.RootCommand().AddCommand("completion", command.New("log collector"))
 	c.Run(ctx, os.Args)
+	if cmd.Failed() {
+		cancel()
+		os.Exit(1)
+	}
 }
 
 func initLogger() {
@@ -39,3 +47,14 @@ func initLogger() {
 	xlog.SetLogger(logger)
 	log.SetOutput(logger)
 }
+
+// stopOnSignal cancels the context on SIGINT or SIGTERM, so the commands can stop cleanly.
+// A second signal exits immediately.
+func stopOnSignal(cancel context.CancelFunc) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	logger.Infof("Got %s, stopping...", <-sig)
+	cancel()
+	logger.Infof("Got %s, exit", <-sig)
+	os.Exit(1)
+}
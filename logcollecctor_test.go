@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs main instead of the tests in the processes started by TestExitCode.
+func TestMain(m *testing.M) {
+	if os.Getenv("LOGCOLLECTOR_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logcollector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "collect.yml")
+	err = ioutil.WriteFile(conf, []byte("storage: ndjson\nsinks:\n  ndjson:\n    dir: "+dir+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.ndjson")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"replay-dlq", "-config", conf, "-file", empty}, 0},
+		{[]string{"replay-dlq", "-config", conf, "-file", filepath.Join(dir, "missing.ndjson")}, 1},
+		{[]string{"collect", "-config", filepath.Join(dir, "missing.yml")}, 1},
+	}
+	for _, tt := range tests {
+		c := exec.Command(os.Args[0], tt.args...)
+		c.Env = append(os.Environ(), "LOGCOLLECTOR_MAIN=1")
+		err := c.Run()
+		code := 0
+		if exit, ok := err.(*exec.ExitError); ok {
+			code = exit.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%v: exit code %d, want %d", tt.args, code, tt.code)
+		}
+	}
+}